@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	quicwire "github.com/nexodus-io/quicwire/internal"
+	"github.com/urfave/cli/v2"
+)
+
+// checkConfigRun validates the config file given as argument, or by --config-file
+func checkConfigRun(cCtx *cli.Context) error {
+	configFile := cCtx.Args().First()
+	if configFile == "" {
+		configFile = cCtx.String("config-file")
+	}
+	if configFile == "" {
+		return fmt.Errorf("no config file given")
+	}
+	peers, warnings, err := quicwire.CheckConfig(configFile)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(cCtx.App.ErrWriter, "%s: warning: %s\n", configFile, warning)
+	}
+	fmt.Fprintf(cCtx.App.Writer, "%s: ok, %d peers\n", configFile, peers)
+	return nil
+}
+
+// convertRun writes the wg-quick file given as argument in the quicwire format to stdout
+func convertRun(cCtx *cli.Context) error {
+	configFile := cCtx.Args().First()
+	if configFile == "" {
+		return fmt.Errorf("usage: %s", cCtx.Command.ArgsUsage)
+	}
+	file, err := os.Open(configFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := quicwire.ConvertWgQuick(configFile, file, cCtx.App.Writer); err != nil {
+		return err
+	}
+	fmt.Fprintln(cCtx.App.ErrWriter, "The node got a new PrivateKey. Replace the PublicKey placeholder of each peer with its quicwire public key, printed by qw pubkey from its PrivateKey")
+	return nil
+}
+
+// schemaRun prints the JSON Schema of JSON and YAML config files
+func schemaRun(cCtx *cli.Context) error {
+	_, err := cCtx.App.Writer.Write(quicwire.ConfigSchema())
+	return err
+}
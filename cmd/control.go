@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	quicwire "github.com/nexodus-io/quicwire/internal"
+	"github.com/urfave/cli/v2"
+)
+
+// socketFlag selects the control socket of the node to talk to
+var socketFlag = &cli.StringFlag{
+	Name:  "socket",
+	Value: quicwire.DefaultControlSocket,
+	Usage: "Control socket of the running node",
+}
+
+// showRun prints the status of the running node and its peers
+func showRun(cCtx *cli.Context) error {
+	status, err := quicwire.ControlShow(cCtx.String("socket"))
+	if err != nil {
+		return err
+	}
+	printStatus(cCtx.App.Writer, status, time.Now())
+	return nil
+}
+
+// printStatus prints the status in the format of wg show
+func printStatus(w io.Writer, status *quicwire.InterfaceStatus, now time.Time) {
+	fmt.Fprintf(w, "interface: %s\n", status.Name)
+	if status.PublicKey != "" {
+		fmt.Fprintf(w, "  public key: %s\n", status.PublicKey)
+	}
+	fmt.Fprintf(w, "  listening port: %d\n", status.ListenPort)
+	for _, peer := range status.Peers {
+		fmt.Fprintf(w, "\npeer: %s\n", peer.Identity)
+		if peer.LearnedEndpoint != "" {
+			fmt.Fprintf(w, "  endpoint: %s\n", peer.LearnedEndpoint)
+		} else if peer.Endpoint != "" {
+			fmt.Fprintf(w, "  endpoint: %s\n", peer.Endpoint)
+		}
+		if peer.Endpoint != "" && peer.LearnedEndpoint != "" && peer.Endpoint != peer.LearnedEndpoint {
+			fmt.Fprintf(w, "  configured endpoint: %s\n", peer.Endpoint)
+		}
+		allowedIPs := make([]string, 0, len(peer.AllowedIPs))
+		for _, prefix := range peer.AllowedIPs {
+			allowedIPs = append(allowedIPs, prefix.String())
+		}
+		if len(allowedIPs) == 0 {
+			allowedIPs = append(allowedIPs, "(none)")
+		}
+		fmt.Fprintf(w, "  allowed ips: %s\n", strings.Join(allowedIPs, ", "))
+		fmt.Fprintf(w, "  state: %s\n", peer.State)
+		if !peer.LastHandshake.IsZero() {
+			fmt.Fprintf(w, "  latest handshake: %s ago\n", now.Sub(peer.LastHandshake).Truncate(time.Second))
+		}
+		if peer.RxBytes > 0 || peer.TxBytes > 0 {
+			fmt.Fprintf(w, "  transfer: %s received, %s sent\n", formatBytes(peer.RxBytes), formatBytes(peer.TxBytes))
+		}
+		if peer.SpoofedPackets > 0 || peer.InvalidPackets > 0 {
+			fmt.Fprintf(w, "  dropped: %d spoofed, %d invalid packets\n", peer.SpoofedPackets, peer.InvalidPackets)
+		}
+		if peer.LastError != "" {
+			fmt.Fprintf(w, "  last error: %s (%s ago)\n", peer.LastError, now.Sub(peer.LastErrorTime).Truncate(time.Second))
+		}
+	}
+}
+
+// formatBytes formats a byte count with a binary unit
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// setRun changes a peer of the running node: set peer <key> [endpoint=<host:port>] [allowed-ips=<cidr>,...] [remove]
+func setRun(cCtx *cli.Context) error {
+	args := cCtx.Args().Slice()
+	if len(args) < 2 || args[0] != "peer" {
+		return fmt.Errorf("usage: %s", cCtx.Command.ArgsUsage)
+	}
+	update := quicwire.PeerUpdate{Identity: args[1]}
+	for _, arg := range args[2:] {
+		if arg == "remove" {
+			update.Remove = true
+			continue
+		}
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid argument %q, expected key=value or remove", arg)
+		}
+		switch key {
+		case "endpoint":
+			endpoint := value
+			update.Endpoint = &endpoint
+		case "allowed-ips":
+			allowedIPs, err := quicwire.ParseAllowedIPs(value)
+			if err != nil {
+				return err
+			}
+			if allowedIPs == nil {
+				// allowed-ips= clears the AllowedIPs of the peer
+				allowedIPs = []netip.Prefix{}
+			}
+			update.AllowedIPs = &allowedIPs
+		default:
+			return fmt.Errorf("unknown peer setting %q", key)
+		}
+	}
+	return quicwire.ControlSetPeer(cCtx.String("socket"), update)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	quicwire "github.com/nexodus-io/quicwire/internal"
+	"github.com/urfave/cli/v2"
+)
+
+// genkeyRun prints a new base64 encoded private key
+func genkeyRun(cCtx *cli.Context) error {
+	key, err := quicwire.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(cCtx.App.Writer, key.String())
+	return nil
+}
+
+// pubkeyRun reads a base64 encoded private key from stdin and prints its public key
+func pubkeyRun(cCtx *cli.Context) error {
+	line, err := bufio.NewReader(cCtx.App.Reader).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("failed to read private key from stdin: %w", err)
+	}
+	key, err := quicwire.ParsePrivateKey(strings.TrimSpace(line))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(cCtx.App.Writer, key.PublicKey().String())
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
@@ -21,6 +22,9 @@ const (
 )
 
 func qnetRun(cCtx *cli.Context, logger *zap.Logger) error {
+	if cCtx.String("config-file") == "" {
+		return fmt.Errorf("required flag \"config-file\" not set")
+	}
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
 	defer cancel()
 	if cCtx.String("cpuprofile") != "" {
@@ -49,9 +53,20 @@ func qnetRun(cCtx *cli.Context, logger *zap.Logger) error {
 		}
 	}
 
+	netstack := cCtx.Bool("netstack")
+	if !netstack && (cCtx.String("socks5-proxy") != "" || cCtx.String("http-proxy") != "") {
+		return fmt.Errorf("the proxies need --netstack")
+	}
+	controlSocket := cCtx.String("control-socket")
+	if netstack && !cCtx.IsSet("control-socket") {
+		// The default path is only writable by root, which netstack mode doesn't need
+		controlSocket = ""
+	}
+
 	quicwire, err := quicwire.NewQuicWire(
 		logger.Sugar(),
 		cCtx.String("config-file"),
+		controlSocket,
 		cCtx.Bool("disable-client"),
 		cCtx.Bool("disable-server"),
 	)
@@ -61,12 +76,57 @@ func qnetRun(cCtx *cli.Context, logger *zap.Logger) error {
 
 	wg := &sync.WaitGroup{}
 
-	if err := quicwire.Start(ctx, wg); err != nil {
+	// SIGHUP reloads the config file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	if netstack {
+		quicwire.EnableNetstack()
+	}
+	if cCtx.Bool("disable-stun") {
+		quicwire.DisableSTUN()
+	}
+	// Tear down what was set up, including the PreDown and PostDown hooks,
+	// before exiting on an error
+	fatal := func(err error) {
+		quicwire.Stop()
+		wg.Wait()
 		logger.Fatal(err.Error())
 	}
-	<-ctx.Done()
+	if err := quicwire.Start(ctx, wg); err != nil {
+		fatal(err)
+	}
+	if address := cCtx.String("socks5-proxy"); address != "" {
+		if err := quicwire.ServeSOCKS5(address); err != nil {
+			fatal(err)
+		}
+	}
+	if address := cCtx.String("http-proxy"); address != "" {
+		if err := quicwire.ServeHTTPProxy(address); err != nil {
+			fatal(err)
+		}
+	}
+	if cCtx.Bool("watch-config") {
+		quicwire.WatchConfig()
+	}
+	for ctx.Err() == nil {
+		select {
+		case <-hup:
+			logger.Info("Received SIGHUP, reloading config")
+			if err := quicwire.Reload(); err != nil {
+				logger.Error(err.Error())
+			}
+		case <-quicwire.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}
 	quicwire.Stop()
 	wg.Wait()
+	if err := quicwire.Err(); err != nil {
+		logger.Fatal(err.Error())
+	}
 
 	return nil
 }
@@ -100,7 +160,7 @@ func main() {
 				Name:     "config-file",
 				Value:    "",
 				Usage:    "Quic network configuration file",
-				Required: true,
+				Required: false,
 				Category: tunnelOptions,
 			},
 			&cli.BoolFlag{
@@ -117,6 +177,48 @@ func main() {
 				Required: false,
 				Category: tunnelOptions,
 			},
+			&cli.BoolFlag{
+				Name:     "disable-stun",
+				Value:    false,
+				Usage:    "Don't ask the public STUN servers for the address of the node on start",
+				Required: false,
+				Category: tunnelOptions,
+			},
+			&cli.BoolFlag{
+				Name:     "watch-config",
+				Value:    false,
+				Usage:    "Reload the config file when it changes, as on SIGHUP",
+				Required: false,
+				Category: tunnelOptions,
+			},
+			&cli.StringFlag{
+				Name:     "control-socket",
+				Value:    quicwire.DefaultControlSocket,
+				Usage:    "Unix socket serving qw show and qw set, empty to disable",
+				Required: false,
+				Category: tunnelOptions,
+			},
+			&cli.BoolFlag{
+				Name:     "netstack",
+				Value:    false,
+				Usage:    "Terminate the tunnel in a userspace TCP/IP stack instead of a TUN interface, without root",
+				Required: false,
+				Category: tunnelOptions,
+			},
+			&cli.StringFlag{
+				Name:     "socks5-proxy",
+				Value:    "",
+				Usage:    "Serve a SOCKS5 proxy into the mesh on this address, such as 127.0.0.1:1080 (needs --netstack)",
+				Required: false,
+				Category: tunnelOptions,
+			},
+			&cli.StringFlag{
+				Name:     "http-proxy",
+				Value:    "",
+				Usage:    "Serve an HTTP proxy into the mesh on this address, such as 127.0.0.1:8080 (needs --netstack)",
+				Required: false,
+				Category: tunnelOptions,
+			},
 			&cli.StringFlag{
 				Name:     "cpuprofile",
 				Value:    "",
@@ -132,6 +234,48 @@ func main() {
 				Category: miscOptions,
 			},
 		},
+		Commands: []*cli.Command{
+			{
+				Name:   "genkey",
+				Usage:  "Generate a new private key and print it in base64",
+				Action: genkeyRun,
+			},
+			{
+				Name:   "pubkey",
+				Usage:  "Read a private key from stdin and print its public key in base64",
+				Action: pubkeyRun,
+			},
+			{
+				Name:      "check-config",
+				Usage:     "Validate a config file without starting the node",
+				ArgsUsage: "[config file]",
+				Action:    checkConfigRun,
+			},
+			{
+				Name:      "convert",
+				Usage:     "Convert a wg-quick config file to the quicwire format, written to stdout",
+				ArgsUsage: "<wg-quick config file>",
+				Action:    convertRun,
+			},
+			{
+				Name:   "schema",
+				Usage:  "Print the JSON Schema of JSON and YAML config files",
+				Action: schemaRun,
+			},
+			{
+				Name:   "show",
+				Usage:  "Show the status of the running node and its peers",
+				Flags:  []cli.Flag{socketFlag},
+				Action: showRun,
+			},
+			{
+				Name:      "set",
+				Usage:     "Add, change or remove a peer of the running node",
+				ArgsUsage: "peer <public key> [endpoint=<host:port>] [allowed-ips=<cidr>,...] [remove]",
+				Flags:     []cli.Flag{socketFlag},
+				Action:    setRun,
+			},
+		},
 		Action: func(cCtx *cli.Context) error {
 			return qnetRun(cCtx, logger)
 		},
@@ -0,0 +1,379 @@
+// dpbench measures the packet forwarding rate of the dataplane end to end. It
+// starts two nodes in the process, connected over QUIC on the loopback
+// interface, and sends UDP packets of each size through the first one with a
+// Device that keeps a window of packets in flight, like a TCP sender. The
+// packets delivered by the second node give the packets per second and the
+// throughput of the tunnel. The benchmarks of the internal package, run with
+// make bench, measure each stage of the dataplane; dpbench complements them
+// with runs of a fixed duration and profiles.
+//
+//	go run ./hack/dpbench -sizes 64,512,1190,1400 -duration 5s
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nexodus-io/quicwire"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	senderAddr   = "10.99.0.1"
+	receiverAddr = "10.99.0.2"
+	benchMTU     = 1500
+)
+
+func main() {
+	var sizes string
+	var duration time.Duration
+	var portBase int
+	var cpuProfile, memProfile string
+	var window int
+	flag.StringVar(&sizes, "sizes", "64,512,1190,1400", "Comma separated sizes of the IP packets")
+	flag.DurationVar(&duration, "duration", 5*time.Second, "Duration of the run of each size")
+	flag.IntVar(&portBase, "port", 51900, "UDP port of the sending node, the receiving node uses the next one")
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "File the CPU profile of the runs is written to")
+	flag.StringVar(&memProfile, "memprofile", "", "File the allocation profile of the runs is written to")
+	flag.IntVar(&window, "window", 256, "Number of packets in flight")
+	flag.Parse()
+
+	var packetSizes []int
+	for _, s := range strings.Split(sizes, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || size < 28 || size > benchMTU {
+			log.Fatalf("invalid packet size %q, it must be between 28 and %d", s, benchMTU)
+		}
+		packetSizes = append(packetSizes, size)
+	}
+
+	sink := newSinkDevice("sink", benchMTU)
+	source := newSourceDevice("src", benchMTU, sink, window)
+	sender, receiver, err := startNodes(source, sink, portBase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sender.Stop()
+	defer receiver.Stop()
+
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal(err)
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	if memProfile != "" {
+		defer func() {
+			f, err := os.Create(memProfile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			if err := pprof.Lookup("allocs").WriteTo(f, 0); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	fmt.Printf("%6s %12s %12s %12s %8s %14s\n", "size", "read", "delivered", "pkts/s", "Gbps", "allocs/packet")
+	for _, size := range packetSizes {
+		r := run(source, sink, udpPacket(size), duration)
+		fmt.Printf("%6d %12d %12d %12.0f %8.3f %14.1f\n", size, r.read, r.delivered,
+			float64(r.delivered)/duration.Seconds(),
+			float64(r.bytes)*8/duration.Seconds()/1e9,
+			float64(r.mallocs)/float64(max(r.delivered, 1)))
+	}
+}
+
+// result counts the packets of a run
+type result struct {
+	read      uint64
+	delivered uint64
+	bytes     uint64
+	mallocs   uint64
+}
+
+// run floods the sending node with packet for duration
+func run(source *sourceDevice, sink *sinkDevice, packet []byte, duration time.Duration) result {
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	read, delivered, bytes := source.read.Load(), sink.packets.Load(), sink.bytes.Load()
+
+	source.start(packet)
+	time.Sleep(duration)
+	source.stop()
+	runtime.ReadMemStats(&after)
+	// Let the packets in flight arrive, they still count for the run
+	time.Sleep(200 * time.Millisecond)
+
+	return result{
+		read:      source.read.Load() - read,
+		delivered: sink.packets.Load() - delivered,
+		bytes:     sink.bytes.Load() - bytes,
+		mallocs:   after.Mallocs - before.Mallocs,
+	}
+}
+
+func max(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// startNodes starts a node reading from source, which dials a node writing to sink
+func startNodes(source, sink quicwire.Device, portBase int) (*quicwire.Node, *quicwire.Node, error) {
+	senderKey, err := quicwire.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	receiverKey, err := quicwire.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	senderPub, _ := quicwire.PublicKey(senderKey)
+	receiverPub, _ := quicwire.PublicKey(receiverKey)
+
+	sender, err := quicwire.NewNode(quicwire.Config{
+		Interface: quicwire.InterfaceConfig{
+			LocalEndpoint: []string{senderAddr + "/32"},
+			LocalNodeIP:   "127.0.0.1",
+			ListenPort:    portBase,
+			PrivateKey:    senderKey,
+		},
+		Peers: []quicwire.PeerConfig{{
+			PublicKey:  receiverPub,
+			AllowedIPs: []string{receiverAddr + "/32"},
+			Endpoint:   fmt.Sprintf("127.0.0.1:%d", portBase+1),
+		}},
+	}, quicwire.Options{Device: source, DisableServer: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	receiver, err := quicwire.NewNode(quicwire.Config{
+		Interface: quicwire.InterfaceConfig{
+			LocalEndpoint: []string{receiverAddr + "/32"},
+			LocalNodeIP:   "127.0.0.1",
+			ListenPort:    portBase + 1,
+			PrivateKey:    receiverKey,
+		},
+		Peers: []quicwire.PeerConfig{{
+			PublicKey:  senderPub,
+			AllowedIPs: []string{senderAddr + "/32"},
+		}},
+	}, quicwire.Options{Device: sink, DisableClient: true, DisableSTUN: true})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx := context.Background()
+	if err := receiver.Start(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err := sender.Start(ctx); err != nil {
+		receiver.Stop()
+		return nil, nil, err
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for sender.Stats().ConnectedPeers == 0 || receiver.Stats().ConnectedPeers == 0 {
+		if time.Now().After(deadline) {
+			sender.Stop()
+			receiver.Stop()
+			return nil, nil, fmt.Errorf("the nodes didn't connect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return sender, receiver, nil
+}
+
+// udpPacket returns an IPv4 UDP packet of size bytes from the sending node to
+// the receiving node. Its checksums are left to zero, the nodes don't check them.
+func udpPacket(size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(size))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], []byte{10, 99, 0, 1})
+	copy(packet[16:20], []byte{10, 99, 0, 2})
+	binary.BigEndian.PutUint16(packet[20:], 40000)
+	binary.BigEndian.PutUint16(packet[22:], 9)
+	binary.BigEndian.PutUint16(packet[24:], uint16(size-20))
+	return packet
+}
+
+// lossTimeout is the time after which the packets in flight are considered lost
+const lossTimeout = 20 * time.Millisecond
+
+// sourceDevice is a Device that returns copies of a packet while a run is
+// going on, as long as less than window packets are in flight to sink
+type sourceDevice struct {
+	name   string
+	mtu    int
+	sink   *sinkDevice
+	window uint64
+	mu     sync.Mutex
+	cond   *sync.Cond
+	packet []byte
+	closed bool
+	read   atomic.Uint64
+	// lost counts the packets that never reached sink
+	lost uint64
+}
+
+func newSourceDevice(name string, mtu int, sink *sinkDevice, window int) *sourceDevice {
+	d := &sourceDevice{name: name, mtu: mtu, sink: sink, window: uint64(window)}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+func (d *sourceDevice) start(packet []byte) {
+	d.mu.Lock()
+	d.packet = packet
+	d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+func (d *sourceDevice) stop() {
+	d.mu.Lock()
+	d.packet = nil
+	d.mu.Unlock()
+}
+
+// next waits for a run and for room in the window, and returns the packet
+// of the run with the number of copies that fit in the window
+func (d *sourceDevice) next(max int) ([]byte, int, error) {
+	d.mu.Lock()
+	for d.packet == nil && !d.closed {
+		d.cond.Wait()
+	}
+	packet, closed := d.packet, d.closed
+	d.mu.Unlock()
+	if closed {
+		return nil, 0, os.ErrClosed
+	}
+	for {
+		inFlight := d.read.Load() - d.sink.packets.Load() - d.lost
+		if inFlight < d.window {
+			room := int(d.window - inFlight)
+			if room > max {
+				room = max
+			}
+			return packet, room, nil
+		}
+		select {
+		case <-d.sink.delivered:
+		case <-time.After(lossTimeout):
+			d.lost = d.read.Load() - d.sink.packets.Load()
+		}
+	}
+}
+
+func (d *sourceDevice) Name() string { return d.name }
+func (d *sourceDevice) MTU() int     { return d.mtu }
+
+func (d *sourceDevice) Read(buf []byte) (int, error) {
+	packet, _, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	d.read.Add(1)
+	return copy(buf, packet), nil
+}
+
+func (d *sourceDevice) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	packet, n, err := d.next(len(bufs))
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		sizes[i] = copy(bufs[i], packet)
+	}
+	d.read.Add(uint64(n))
+	return n, nil
+}
+
+func (d *sourceDevice) Write(packet []byte) (int, error) {
+	return len(packet), nil
+}
+
+func (d *sourceDevice) WriteBatch(packets [][]byte) (int, error) {
+	return len(packets), nil
+}
+
+func (d *sourceDevice) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	d.cond.Broadcast()
+	return nil
+}
+
+// sinkDevice is a Device that counts the packets written to it
+type sinkDevice struct {
+	name    string
+	mtu     int
+	closed  chan struct{}
+	once    sync.Once
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+	// delivered wakes up the source waiting for room in its window
+	delivered chan struct{}
+}
+
+func newSinkDevice(name string, mtu int) *sinkDevice {
+	return &sinkDevice{name: name, mtu: mtu, closed: make(chan struct{}), delivered: make(chan struct{}, 1)}
+}
+
+func (d *sinkDevice) Name() string { return d.name }
+func (d *sinkDevice) MTU() int     { return d.mtu }
+
+func (d *sinkDevice) Read(buf []byte) (int, error) {
+	<-d.closed
+	return 0, os.ErrClosed
+}
+
+func (d *sinkDevice) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	<-d.closed
+	return 0, os.ErrClosed
+}
+
+func (d *sinkDevice) Write(packet []byte) (int, error) {
+	return d.WriteBatch([][]byte{packet})
+}
+
+func (d *sinkDevice) WriteBatch(packets [][]byte) (int, error) {
+	var bytes uint64
+	for _, packet := range packets {
+		bytes += uint64(len(packet))
+	}
+	d.bytes.Add(bytes)
+	d.packets.Add(uint64(len(packets)))
+	select {
+	case d.delivered <- struct{}{}:
+	default:
+	}
+	return len(packets), nil
+}
+
+func (d *sinkDevice) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
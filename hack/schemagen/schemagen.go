@@ -0,0 +1,265 @@
+// schemagen generates the JSON Schema of the structured config files from the
+// Go types that decode them. Descriptions come from the doc comments, and the
+// jsonschema struct tag adds constraints: required, minimum, maximum,
+// minItems and pattern, which must come last.
+//
+//	go run ./hack/schemagen -o internal/config.schema.json internal/config.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// schema is a JSON Schema, marshaled with sorted keys
+type schema map[string]any
+
+func main() {
+	var output string
+	var root string
+	flag.StringVar(&output, "o", "", "File the schema is written to, stdout by default")
+	flag.StringVar(&root, "type", "Config", "Type of the whole config file")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalf("usage: schemagen [-o file] [-type name] <go file>")
+	}
+
+	g, err := newGenerator(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := g.generate(root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append(data, '\n')
+	if output == "" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(output, data, 0o644)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generator builds the schema of the types declared in a Go file
+type generator struct {
+	types map[string]*ast.TypeSpec
+	docs  map[string]string
+	defs  schema
+}
+
+func newGenerator(file string) (*generator, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	g := &generator{
+		types: make(map[string]*ast.TypeSpec),
+		docs:  make(map[string]string),
+		defs:  make(schema),
+	}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			g.types[ts.Name.Name] = ts
+			doc := ts.Doc
+			if doc == nil {
+				doc = gen.Doc
+			}
+			g.docs[ts.Name.Name] = description(doc)
+		}
+	}
+	return g, nil
+}
+
+// generate returns the schema of the root type, with the types it uses in $defs
+func (g *generator) generate(root string) (schema, error) {
+	s, err := g.typeSchema(root)
+	if err != nil {
+		return nil, err
+	}
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "quicwire config"
+	if len(g.defs) > 0 {
+		s["$defs"] = g.defs
+	}
+	return s, nil
+}
+
+// typeSchema returns the schema of a declared type
+func (g *generator) typeSchema(name string) (schema, error) {
+	ts, ok := g.types[name]
+	if !ok {
+		return nil, fmt.Errorf("type %s is not declared", name)
+	}
+	s, err := g.exprSchema(ts.Type)
+	if err != nil {
+		return nil, fmt.Errorf("type %s: %w", name, err)
+	}
+	if doc := g.docs[name]; doc != "" {
+		s["description"] = doc
+	}
+	return s, nil
+}
+
+// exprSchema returns the schema of a type expression
+func (g *generator) exprSchema(expr ast.Expr) (schema, error) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return schema{"type": "string"}, nil
+		case "int", "int32", "int64", "uint16", "uint32", "uint64":
+			return schema{"type": "integer"}, nil
+		case "bool":
+			return schema{"type": "boolean"}, nil
+		}
+		if _, ok := g.types[t.Name]; !ok {
+			return nil, fmt.Errorf("unsupported type %s", t.Name)
+		}
+		if _, ok := g.defs[t.Name]; !ok {
+			// Reserve the name first, so recursive types terminate
+			g.defs[t.Name] = schema{}
+			def, err := g.typeSchema(t.Name)
+			if err != nil {
+				return nil, err
+			}
+			g.defs[t.Name] = def
+		}
+		return schema{"$ref": "#/$defs/" + t.Name}, nil
+	case *ast.SelectorExpr:
+		if pkg, ok := t.X.(*ast.Ident); ok && pkg.Name == "time" && t.Sel.Name == "Duration" {
+			// Durations are a number of seconds or a string with units
+			return schema{"anyOf": []schema{
+				{"type": "integer", "minimum": 0},
+				{"type": "string", "pattern": `^([0-9]+|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`},
+			}}, nil
+		}
+	case *ast.ArrayType:
+		if t.Len == nil {
+			items, err := g.exprSchema(t.Elt)
+			if err != nil {
+				return nil, err
+			}
+			return schema{"type": "array", "items": items}, nil
+		}
+	case *ast.StructType:
+		return g.structSchema(t)
+	}
+	return nil, fmt.Errorf("unsupported type expression %T", expr)
+}
+
+// structSchema returns the schema of the JSON object of a struct
+func (g *generator) structSchema(st *ast.StructType) (schema, error) {
+	properties := make(schema)
+	var required []string
+	for _, field := range st.Fields.List {
+		var tag reflect.StructTag
+		if field.Tag != nil {
+			value, err := strconv.Unquote(field.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+			tag = reflect.StructTag(value)
+		}
+		jsonName, _, _ := strings.Cut(tag.Get("json"), ",")
+		if jsonName == "-" || len(field.Names) != 1 || !field.Names[0].IsExported() {
+			continue
+		}
+		if jsonName == "" {
+			jsonName = field.Names[0].Name
+		}
+
+		s, err := g.exprSchema(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Names[0].Name, err)
+		}
+		if _, ok := s["$ref"]; ok {
+			// $ref can't have siblings in older drafts, wrap it to add a description
+			s = schema{"allOf": []schema{s}}
+		}
+		if doc := description(field.Doc); doc != "" {
+			s["description"] = doc
+		}
+		isRequired, err := applyConstraints(s, tag.Get("jsonschema"))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Names[0].Name, err)
+		}
+		if isRequired {
+			required = append(required, jsonName)
+		}
+		properties[jsonName] = s
+	}
+	s := schema{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s, nil
+}
+
+// applyConstraints adds the constraints of a jsonschema tag to s, and reports
+// whether the field is required
+func applyConstraints(s schema, tag string) (bool, error) {
+	if tag == "" {
+		return false, nil
+	}
+	required := false
+	// A pattern may contain commas, so it runs to the end of the tag
+	if i := strings.Index(tag, "pattern="); i >= 0 {
+		s["pattern"] = tag[i+len("pattern="):]
+		tag = strings.TrimSuffix(tag[:i], ",")
+	}
+	for _, option := range strings.Split(tag, ",") {
+		if option == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "required":
+			required = true
+		case "minimum", "maximum", "minItems":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return false, fmt.Errorf("invalid %s %q", key, value)
+			}
+			s[key] = n
+		default:
+			return false, fmt.Errorf("unknown jsonschema option %q", key)
+		}
+	}
+	return required, nil
+}
+
+// description turns a doc comment into a description
+func description(doc *ast.CommentGroup) string {
+	if doc == nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(doc.Text()), " ")
+}
@@ -1,100 +1,115 @@
 package quicwire
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/quic-go/quic-go"
-	"github.com/songgao/water"
 	"go.uber.org/zap"
 )
 
 // Client struct holds state need to enable connectivity to peer
 type Client struct {
-	addr            string
-	localip         net.IP
-	localport       int
-	handler         Handler
-	tunnelInterface *water.Interface
-	connection      quic.Connection
-	logger          *zap.SugaredLogger
+	addr       string
+	peer       string
+	localip    net.IP
+	localport  int
+	connection *quic.Conn
+	tlsConf    *tls.Config
+	quicConf   *quic.Config
+	// dialed is set when the connection was initiated by this node
+	dialed bool
+	// since is the time the connection was established
+	since      time.Time
+	fragmenter fragmenter
+	// scratch holds the fragment being sent by SendBytes
+	scratch []byte
+	logger  *zap.SugaredLogger
 }
 
 // NewClient creates a new client
-func NewClient(addr string, localip string, localport int, tunIface *water.Interface, logger *zap.SugaredLogger) *Client {
+func NewClient(addr string, peer string, localip string, localport int, tlsConf *tls.Config, quicConf *quic.Config, logger *zap.SugaredLogger) (*Client, error) {
 
 	ipAddr := net.ParseIP(localip)
 
 	if ipAddr == nil {
-		logger.Fatalf("Failed to parse IP address %s", localip)
+		return nil, fmt.Errorf("failed to parse IP address %s", localip)
 	}
 	return &Client{
-		addr:            addr,
-		localip:         ipAddr,
-		localport:       localport,
-		tunnelInterface: tunIface,
-		logger:          logger,
-	}
-}
-
-// AttachHandler attaches a handler to process incoming packets
-func (c *Client) AttachHandler(handler Handler) {
-	c.handler = handler
-	go func() {
-		err := handleMsg(c.tunnelInterface, c.connection, c.handler)
-		if err != nil {
-			fmt.Printf("handler err: %v", err)
-		}
-	}()
+		addr:      addr,
+		peer:      peer,
+		localip:   ipAddr,
+		localport: localport,
+		tlsConf:   tlsConf,
+		quicConf:  quicConf,
+		logger:    logger,
+	}, nil
 }
 
 // SetConnection sets the currently active connection to the peer
-func (c *Client) SetConnection(conn quic.Connection) {
+func (c *Client) SetConnection(conn *quic.Conn) {
 	c.connection = conn
+	c.since = time.Now()
 }
 
 // Dial establishes a connection to the peer
-func (c *Client) Dial(udpConn *net.UDPConn) error {
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"some-proto"},
-	}
-
+func (c *Client) Dial(ctx context.Context, tr *quic.Transport) error {
 	udpAddr, err := net.ResolveUDPAddr("udp", c.addr)
 	if err != nil {
 		return err
 	}
 
-	conn, err := quic.Dial(udpConn, udpAddr, c.addr, tlsConf, &quic.Config{
-		KeepAlivePeriod: 10,
-		EnableDatagrams: true,
-	})
+	conn, err := tr.Dial(ctx, udpAddr, c.tlsConf, c.quicConf)
 
 	if err != nil {
 		return err
 	}
-	c.connection = conn
+	c.SetConnection(conn)
+	c.dialed = true
 	return nil
 }
 
+// remoteKeyInfo returns the DER encoded public key the peer authenticated with
+func (c *Client) remoteKeyInfo() []byte {
+	certs := c.connection.ConnectionState().TLS.PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0].RawSubjectPublicKeyInfo
+}
+
+// SendKeepalive sends an empty datagram that keeps the path to the peer open
+func (c *Client) SendKeepalive() error {
+	if c.connection == nil {
+		return fmt.Errorf("Client has no active connection to peer %s", c.addr)
+	}
+	return c.connection.SendDatagram(nil)
+}
+
 // Send converts string to byte array and sends it to the peer
 func (c *Client) Send(data string) error {
 	if c.connection == nil {
 		return fmt.Errorf("Client has no active connection to peer %s", c.addr)
 	}
-	err := c.connection.SendMessage([]byte(data))
+	err := c.connection.SendDatagram([]byte(data))
 	return err
 }
 
-// SendBytes sends byte array to the peer
+// SendBytes sends byte array to the peer, split over several datagrams if
+// needed. It must not be called concurrently, data can be reused once it returns.
 func (c *Client) SendBytes(data []byte) error {
 	if c.connection == nil {
 		return fmt.Errorf("Client has no active connection to peer %s", c.addr)
 	}
-	err := c.connection.SendMessage(data)
-	return err
+	if c.scratch == nil && len(data) > maxDatagramSize {
+		c.scratch = make([]byte, maxDatagramSize)
+	}
+	// SendDatagram copies the datagram, so the scratch buffer can be reused
+	return c.fragmenter.fragment(data, c.scratch, c.connection.SendDatagram)
 }
 
 // SendJSON converts data to json and sends it to the peer
@@ -106,5 +121,5 @@ func (c *Client) SendJSON(data any) error {
 	if err != nil {
 		return err
 	}
-	return c.connection.SendMessage(res)
+	return c.connection.SendDatagram(res)
 }
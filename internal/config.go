@@ -0,0 +1,204 @@
+package quicwire
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:generate go run ../hack/schemagen -o config.schema.json config.go
+
+// configSchema is the JSON Schema of Config, generated from this file
+//
+//go:embed config.schema.json
+var configSchema []byte
+
+// ConfigSchema returns the JSON Schema of the structured config files
+func ConfigSchema() []byte {
+	return configSchema
+}
+
+// Config is the configuration of a node in a JSON or YAML config file. It
+// holds the same settings as the INI config file and is validated by the
+// same rules.
+type Config struct {
+	// Interface configures the tunnel interface and the identity of the node
+	Interface InterfaceConfig `json:"interface" yaml:"interface" jsonschema:"required"`
+	// Peers are the nodes this node exchanges packets with
+	Peers []PeerConfig `json:"peers,omitempty" yaml:"peers,omitempty"`
+}
+
+// InterfaceConfig is the [Interface] section of the config
+type InterfaceConfig struct {
+	// LocalEndpoint are the IP addresses or CIDRs assigned to the tunnel interface
+	LocalEndpoint []string `json:"localEndpoint" yaml:"localEndpoint" jsonschema:"required,minItems=1"`
+	// LocalNodeIP is the IP address the node listens on for connections from peers
+	LocalNodeIP string `json:"localNodeIp" yaml:"localNodeIp" jsonschema:"required"`
+	// ListenPort is the UDP port the node listens on for connections from peers
+	ListenPort int `json:"listenPort" yaml:"listenPort" jsonschema:"required,minimum=1,maximum=65535"`
+	// PrivateKey is the base64 encoded Ed25519 private key identifying the node, unless CAFile is set
+	PrivateKey string `json:"privateKey,omitempty" yaml:"privateKey,omitempty"`
+	// CAFile is the PEM file of the CA that issues the certificates of the nodes
+	CAFile string `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+	// CertFile is the PEM certificate of the node issued by the CA
+	CertFile string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+	// KeyFile is the PEM private key of the certificate of the node
+	KeyFile string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+	// Table is the routing table of the AllowedIPs routes of the peers: auto, off or a table number
+	Table string `json:"table,omitempty" yaml:"table,omitempty" jsonschema:"pattern=^(auto|off|[1-9][0-9]*)$"`
+	// IdleTimeout is the time without any packet from a peer after which its connection is closed
+	IdleTimeout Duration `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`
+	// HandshakeTimeout is the time to wait for the handshake of a new connection to complete
+	HandshakeTimeout Duration `json:"handshakeTimeout,omitempty" yaml:"handshakeTimeout,omitempty"`
+	// MTU of the tunnel interface, picked from the tunneled address families when unset
+	MTU int `json:"mtu,omitempty" yaml:"mtu,omitempty" jsonschema:"minimum=576,maximum=65535"`
+	// PreUp are shell commands run before the tunnel interface is created
+	PreUp []string `json:"preUp,omitempty" yaml:"preUp,omitempty"`
+	// PostUp are shell commands run once the tunnel interface is set up, %i is replaced by its name
+	PostUp []string `json:"postUp,omitempty" yaml:"postUp,omitempty"`
+	// PreDown are shell commands run before the tunnel interface is torn down, %i is replaced by its name
+	PreDown []string `json:"preDown,omitempty" yaml:"preDown,omitempty"`
+	// PostDown are shell commands run once the tunnel interface is removed, %i is replaced by its name
+	PostDown []string `json:"postDown,omitempty" yaml:"postDown,omitempty"`
+}
+
+// PeerConfig is a [Peer] section of the config
+type PeerConfig struct {
+	// PublicKey is the base64 encoded Ed25519 public key of the peer, unless a CA is used
+	PublicKey string `json:"publicKey,omitempty" yaml:"publicKey,omitempty"`
+	// Name is the name in the certificate of the peer when a CA is used
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// AllowedIPs are the tunnel IP addresses or CIDRs routed to the peer
+	AllowedIPs []string `json:"allowedIPs" yaml:"allowedIPs" jsonschema:"required"`
+	// Endpoint is the host:port the peer is dialed at, leave it out for peers that connect to this node
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	// PersistentKeepalive is the time of inactivity after which a keepalive is sent to the peer, off when unset
+	PersistentKeepalive Duration `json:"persistentKeepalive,omitempty" yaml:"persistentKeepalive,omitempty"`
+}
+
+// Duration is a duration in a structured config file, written as a number of
+// seconds or a string with a unit such as "1m30s"
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string with a unit
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a number of seconds or a string with a unit
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		return d.set(strconv.FormatFloat(v, 'f', -1, 64))
+	case string:
+		return d.set(v)
+	}
+	return fmt.Errorf("invalid duration %s, expected a number of seconds or a string", data)
+}
+
+// MarshalYAML writes the duration as a string with a unit
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+// UnmarshalYAML reads a number of seconds or a string with a unit
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: invalid duration, expected a number of seconds or a string", value.Line)
+	}
+	if err := d.set(value.Value); err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	return nil
+}
+
+func (d *Duration) set(value string) error {
+	duration, err := parseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration: %w", err)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// keyValue is a setting of a structured config file, named by its INI key
+type keyValue struct {
+	// field is the path of the setting in the structured file
+	field string
+	key   string
+	value string
+}
+
+// keyValues lists the settings of the interface that are set
+func (ic *InterfaceConfig) keyValues() []keyValue {
+	var kvs []keyValue
+	add := func(field, key, value string) {
+		kvs = append(kvs, keyValue{field: field, key: key, value: value})
+	}
+	addList := func(field, key string, values []string) {
+		for i, value := range values {
+			add(fmt.Sprintf("%s[%d]", field, i), key, value)
+		}
+	}
+	addString := func(field, key, value string) {
+		if value != "" {
+			add(field, key, value)
+		}
+	}
+	addInt := func(field, key string, value int) {
+		if value != 0 {
+			add(field, key, strconv.Itoa(value))
+		}
+	}
+	addDuration := func(field, key string, value Duration) {
+		if value != 0 {
+			add(field, key, time.Duration(value).String())
+		}
+	}
+	addList("localEndpoint", "LocalEndpoint", ic.LocalEndpoint)
+	addString("localNodeIp", "LocalNodeIp", ic.LocalNodeIP)
+	addInt("listenPort", "ListenPort", ic.ListenPort)
+	addString("privateKey", "PrivateKey", ic.PrivateKey)
+	addString("caFile", "CAFile", ic.CAFile)
+	addString("certFile", "CertFile", ic.CertFile)
+	addString("keyFile", "KeyFile", ic.KeyFile)
+	addString("table", "Table", ic.Table)
+	addDuration("idleTimeout", "IdleTimeout", ic.IdleTimeout)
+	addDuration("handshakeTimeout", "HandshakeTimeout", ic.HandshakeTimeout)
+	addInt("mtu", "MTU", ic.MTU)
+	addList("preUp", "PreUp", ic.PreUp)
+	addList("postUp", "PostUp", ic.PostUp)
+	addList("preDown", "PreDown", ic.PreDown)
+	addList("postDown", "PostDown", ic.PostDown)
+	return kvs
+}
+
+// keyValues lists the settings of the peer that are set
+func (pc *PeerConfig) keyValues() []keyValue {
+	var kvs []keyValue
+	if pc.PublicKey != "" {
+		kvs = append(kvs, keyValue{field: "publicKey", key: "PublicKey", value: pc.PublicKey})
+	}
+	if pc.Name != "" {
+		kvs = append(kvs, keyValue{field: "name", key: "Name", value: pc.Name})
+	}
+	for i, prefix := range pc.AllowedIPs {
+		kvs = append(kvs, keyValue{field: fmt.Sprintf("allowedIPs[%d]", i), key: "AllowedIPs", value: prefix})
+	}
+	if pc.Endpoint != "" {
+		kvs = append(kvs, keyValue{field: "endpoint", key: "Endpoint", value: pc.Endpoint})
+	}
+	if pc.PersistentKeepalive != 0 {
+		kvs = append(kvs, keyValue{field: "persistentKeepalive", key: "PersistentKeepalive",
+			value: time.Duration(pc.PersistentKeepalive).String()})
+	}
+	return kvs
+}
@@ -0,0 +1,561 @@
+package quicwire
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigError is an error in a config file, located by file name and line,
+// or by the path of the setting in JSON and YAML files
+type ConfigError struct {
+	File string
+	// Line is the 1-based line number, or 0 for errors about the whole file
+	Line int
+	// Path is the path of the setting in a JSON or YAML file, such as peers[1].endpoint
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	switch {
+	case e.Line != 0:
+		return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+	case e.Path != "":
+		return fmt.Sprintf("%s: %s: %v", e.File, e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.File, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	sectionInterface = "Interface"
+	sectionPeer      = "Peer"
+)
+
+// configKeys lists the keys allowed in each section, by their lower case name.
+// It includes the keys of wg-quick files, see wgQuickKeys.
+var configKeys = map[string]map[string]string{
+	sectionInterface: canonicalKeys("ListenPort", "LocalEndpoint", "LocalNodeIp", "PrivateKey",
+		"CAFile", "CertFile", "KeyFile", "Table", "IdleTimeout", "HandshakeTimeout", "MTU",
+		"PreUp", "PostUp", "PreDown", "PostDown",
+		"Address", "DNS", "SaveConfig", "FwMark"),
+	sectionPeer: canonicalKeys("PublicKey", "Name", "AllowedIPs", "Endpoint", "PersistentKeepalive",
+		"PresharedKey"),
+}
+
+// repeatableKeys may be given several times in a section, their values are appended
+var repeatableKeys = map[string]bool{
+	"LocalEndpoint": true,
+	"Address":       true,
+	"AllowedIPs":    true,
+	"DNS":           true,
+	"PreUp":         true,
+	"PostUp":        true,
+	"PreDown":       true,
+	"PostDown":      true,
+}
+
+// wgQuickKeys are the keys of wg-quick files that quicwire has no use for.
+// They are accepted so wg-quick files can be read as they are, and ignored
+// with a warning.
+var wgQuickKeys = map[string]string{
+	"DNS":          "quicwire doesn't configure DNS servers",
+	"SaveConfig":   "quicwire doesn't write the config file",
+	"FwMark":       "quicwire doesn't mark its packets",
+	"PresharedKey": "connections are only secured by the QUIC handshake",
+}
+
+const (
+	// peerKeyPlaceholder is the PublicKey of the peers of a file written by
+	// ConvertWgQuick, the file is rejected until it is replaced
+	peerKeyPlaceholder = "<quicwire public key of the peer>"
+	// defaultListenPort is the ListenPort of wg-quick files that have none
+	defaultListenPort = 55380
+	// defaultLocalNodeIP is the LocalNodeIp of wg-quick files, which listen on every address
+	defaultLocalNodeIP = "0.0.0.0"
+	// minMTU is the smallest MTU of the tunnel interface
+	minMTU = 576
+)
+
+func canonicalKeys(keys ...string) map[string]string {
+	m := make(map[string]string, len(keys))
+	for _, key := range keys {
+		m[strings.ToLower(key)] = key
+	}
+	return m
+}
+
+// confParser parses the INI style config file. Section names and keys are
+// case insensitive, whitespace around "=" is optional and "#" starts a
+// comment that runs to the end of the line. Files in the wg-quick format,
+// which set Address instead of LocalEndpoint, are accepted too: ListenPort
+// and LocalNodeIp are optional and the wg-quick keys quicwire has no use for
+// are ignored with a warning.
+type confParser struct {
+	qc   *QuicConf
+	file string
+
+	// section being parsed, and the location of its header
+	section    string
+	sectionLoc location
+	seen       map[string]bool
+	iface      nodeInterface
+	peer       Peer
+
+	interfaceLoc *location
+	// peerLocs holds the location of each peer in qc.peers
+	peerLocs []location
+	// wgQuick is set when the [Interface] section has an Address, as in wg-quick files
+	wgQuick bool
+	// converting accepts the WireGuard keys of a wg-quick file, which is only
+	// read to be converted by ConvertWgQuick
+	converting bool
+}
+
+// location is where a section or setting was found: a line of an INI file, or
+// a path in a JSON or YAML file
+type location struct {
+	line int
+	path string
+}
+
+func (l location) String() string {
+	if l.path != "" {
+		return l.path
+	}
+	return fmt.Sprintf("line %d", l.line)
+}
+
+// errorAt locates err in the file
+func (cp *confParser) errorAt(loc location, err error) error {
+	return &ConfigError{File: cp.file, Line: loc.line, Path: loc.path, Err: err}
+}
+
+// parseQuicConf parses the INI config read from r into qc. Errors carry the
+// name of the file and the line they were found at.
+func parseQuicConf(qc *QuicConf, file string, r io.Reader) error {
+	return (&confParser{qc: qc, file: file}).parse(r)
+}
+
+// parse parses the INI config read from r
+func (cp *confParser) parse(r io.Reader) error {
+	file := cp.file
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if err := cp.parseLine(scanner.Text(), line); err != nil {
+			var confErr *ConfigError
+			if errors.As(err, &confErr) {
+				return err
+			}
+			return &ConfigError{File: file, Line: line, Err: err}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return &ConfigError{File: file, Err: err}
+	}
+	if err := cp.endSection(); err != nil {
+		return cp.errorAt(cp.sectionLoc, err)
+	}
+	if cp.interfaceLoc == nil {
+		return &ConfigError{File: file, Err: fmt.Errorf("missing [Interface] section")}
+	}
+	return cp.validate()
+}
+
+// parseConfig parses the config of a JSON or YAML file into qc, with the
+// rules of INI files. Errors carry the name of the file and the path of the
+// setting they were found at.
+func parseConfig(qc *QuicConf, file string, conf *Config) error {
+	cp := &confParser{qc: qc, file: file}
+	type section struct {
+		name   string
+		path   string
+		values []keyValue
+	}
+	sections := []section{{name: sectionInterface, path: "interface", values: conf.Interface.keyValues()}}
+	for i := range conf.Peers {
+		sections = append(sections, section{name: sectionPeer, path: fmt.Sprintf("peers[%d]", i), values: conf.Peers[i].keyValues()})
+	}
+	for _, s := range sections {
+		loc := location{path: s.path}
+		if err := cp.startSection(s.name, loc); err != nil {
+			return cp.errorAt(loc, err)
+		}
+		for _, kv := range s.values {
+			if err := cp.setValue(kv.key, kv.value); err != nil {
+				return cp.errorAt(location{path: s.path + "." + kv.field}, err)
+			}
+		}
+		if err := cp.endSection(); err != nil {
+			return cp.errorAt(loc, err)
+		}
+	}
+	return cp.validate()
+}
+
+// parsePeerConfig parses a peer added to a node with interface ni, with the
+// rules of a peer of the config. Errors carry the path of the setting.
+func parsePeerConfig(ni *nodeInterface, conf *PeerConfig) (Peer, error) {
+	qc := &QuicConf{nodeInterface: *ni}
+	cp := &confParser{qc: qc, file: "peer", interfaceLoc: &location{path: "interface"}}
+	var loc location
+	if err := cp.startSection(sectionPeer, loc); err != nil {
+		return Peer{}, err
+	}
+	for _, kv := range conf.keyValues() {
+		if err := cp.setValue(kv.key, kv.value); err != nil {
+			return Peer{}, cp.errorAt(location{path: kv.field}, err)
+		}
+	}
+	if err := cp.endSection(); err != nil {
+		return Peer{}, cp.errorAt(loc, err)
+	}
+	if err := cp.validate(); err != nil {
+		return Peer{}, err
+	}
+	return qc.peers[0], nil
+}
+
+func (cp *confParser) parseLine(text string, line int) error {
+	text = strings.TrimSpace(stripComment(text))
+	if text == "" {
+		return nil
+	}
+
+	if text[0] == '[' {
+		if text[len(text)-1] != ']' {
+			return fmt.Errorf("invalid section header %q", text)
+		}
+		if err := cp.endSection(); err != nil {
+			return cp.errorAt(cp.sectionLoc, err)
+		}
+		return cp.startSection(strings.TrimSpace(text[1:len(text)-1]), location{line: line})
+	}
+
+	key, value, ok := strings.Cut(text, "=")
+	if !ok {
+		return fmt.Errorf("expected Key = Value, got %q", text)
+	}
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	if cp.section == "" {
+		return fmt.Errorf("key %s outside of a section", key)
+	}
+	canonical, ok := configKeys[cp.section][strings.ToLower(key)]
+	if !ok {
+		return fmt.Errorf("unknown key %s in [%s] section", key, cp.section)
+	}
+	if reason, ok := wgQuickKeys[canonical]; ok && value != "" {
+		cp.qc.warnings = append(cp.qc.warnings, fmt.Sprintf("%s at line %d is ignored, %s", canonical, line, reason))
+	}
+	return cp.setValue(canonical, value)
+}
+
+// setValue sets a key of the section being parsed, given by its canonical name
+func (cp *confParser) setValue(key string, value string) error {
+	if cp.seen[key] && !repeatableKeys[key] {
+		return fmt.Errorf("duplicate key %s in [%s] section", key, cp.section)
+	}
+	cp.seen[key] = true
+	if value == "" {
+		return fmt.Errorf("empty value for %s", key)
+	}
+	if _, ok := wgQuickKeys[key]; ok {
+		return nil
+	}
+	if err := cp.setKey(key, value); err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+// stripComment removes the comment that runs from "#" to the end of the line
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+func (cp *confParser) startSection(name string, loc location) error {
+	switch {
+	case strings.EqualFold(name, sectionInterface):
+		if cp.interfaceLoc != nil {
+			return fmt.Errorf("duplicate [Interface] section, the first one is at %s", cp.interfaceLoc)
+		}
+		cp.section = sectionInterface
+		cp.interfaceLoc = &loc
+	case strings.EqualFold(name, sectionPeer):
+		cp.section = sectionPeer
+	default:
+		return fmt.Errorf("unknown section [%s]", name)
+	}
+	cp.sectionLoc = loc
+	cp.seen = make(map[string]bool)
+	cp.iface = nodeInterface{}
+	cp.peer = Peer{}
+	return nil
+}
+
+func (cp *confParser) setKey(key string, value string) error {
+	var err error
+	ni, peer := &cp.iface, &cp.peer
+	switch key {
+	case "ListenPort":
+		ni.listenPort, err = parsePort(value)
+	case "LocalEndpoint", "Address":
+		var addresses []netip.Prefix
+		addresses, err = parseInterfaceAddresses(value)
+		ni.localEndpoint = append(ni.localEndpoint, addresses...)
+	case "LocalNodeIp":
+		if _, err = netip.ParseAddr(value); err == nil {
+			ni.localNodeIP = value
+		}
+	case "PrivateKey":
+		ni.privateKey, err = ParsePrivateKey(value)
+	case "CAFile":
+		ni.caFile = value
+	case "CertFile":
+		ni.certFile = value
+	case "KeyFile":
+		ni.keyFile = value
+	case "Table":
+		ni.table, err = parseRouteTable(value)
+	case "IdleTimeout":
+		ni.idleTimeout, err = parseTimeout(value)
+	case "HandshakeTimeout":
+		ni.handshakeTimeout, err = parseTimeout(value)
+	case "MTU":
+		ni.mtu, err = parseMTU(value)
+	case "PreUp":
+		if strings.Contains(value, "%i") {
+			return fmt.Errorf("%%i can't be used, the interface doesn't exist yet when PreUp runs")
+		}
+		ni.preUp = append(ni.preUp, value)
+	case "PostUp":
+		ni.postUp = append(ni.postUp, value)
+	case "PreDown":
+		ni.preDown = append(ni.preDown, value)
+	case "PostDown":
+		ni.postDown = append(ni.postDown, value)
+	case "PublicKey":
+		if value == peerKeyPlaceholder {
+			return fmt.Errorf("the placeholder left by qw convert must be replaced with the quicwire public key of the peer")
+		}
+		peer.publicKey, err = ParsePublicKey(value)
+	case "Name":
+		peer.name = value
+	case "AllowedIPs":
+		var prefixes []netip.Prefix
+		prefixes, err = ParseAllowedIPs(value)
+		peer.allowedIPs = append(peer.allowedIPs, prefixes...)
+	case "Endpoint":
+		err = validateEndpoint(value)
+		peer.endpoint = value
+	case "PersistentKeepalive":
+		peer.persistentKeepalive, err = parseKeepalive(value)
+	}
+	return err
+}
+
+// endSection checks the section being parsed and stores it in the config
+func (cp *confParser) endSection() error {
+	switch cp.section {
+	case sectionInterface:
+		switch {
+		case cp.seen["Address"] && cp.seen["LocalEndpoint"]:
+			return fmt.Errorf("[Interface] section has both Address and LocalEndpoint, which are the same setting")
+		case cp.seen["Address"]:
+			cp.wgQuick = true
+			if !cp.seen["ListenPort"] {
+				cp.iface.listenPort = defaultListenPort
+			}
+			if !cp.seen["LocalNodeIp"] {
+				cp.iface.localNodeIP = defaultLocalNodeIP
+			}
+		default:
+			for _, key := range []string{"ListenPort", "LocalNodeIp", "LocalEndpoint"} {
+				if !cp.seen[key] {
+					return fmt.Errorf("[Interface] section has no %s", key)
+				}
+			}
+		}
+		cp.qc.nodeInterface = cp.iface
+	case sectionPeer:
+		if !cp.seen["AllowedIPs"] {
+			return fmt.Errorf("[Peer] section has no AllowedIPs")
+		}
+		cp.qc.peers = append(cp.qc.peers, cp.peer)
+		cp.peerLocs = append(cp.peerLocs, cp.sectionLoc)
+	}
+	cp.section = ""
+	return nil
+}
+
+// validate checks the rules that span sections once the whole file is parsed
+func (cp *confParser) validate() error {
+	qc := cp.qc
+	ni := &qc.nodeInterface
+	errAt := func(loc location, format string, args ...any) error {
+		return cp.errorAt(loc, fmt.Errorf(format, args...))
+	}
+
+	if ni.usesCA() {
+		if ni.certFile == "" || ni.keyFile == "" {
+			return errAt(*cp.interfaceLoc, "interface with CAFile needs CertFile and KeyFile")
+		}
+		if ni.privateKey != (PrivateKey{}) {
+			return errAt(*cp.interfaceLoc, "interface with CAFile can't have a PrivateKey")
+		}
+	} else {
+		if ni.certFile != "" || ni.keyFile != "" {
+			return errAt(*cp.interfaceLoc, "CertFile and KeyFile need a CAFile")
+		}
+		if ni.privateKey == (PrivateKey{}) {
+			return errAt(*cp.interfaceLoc, "interface has no PrivateKey")
+		}
+		if cp.wgQuick && !cp.converting {
+			// Any 32 bytes are a valid Ed25519 private key, but reusing the
+			// X25519 key of WireGuard shares a secret between two protocols,
+			// and the PublicKey of the peers can never match theirs
+			return errAt(*cp.interfaceLoc, "the keys of a wg-quick file are WireGuard keys, which quicwire can't use: "+
+				"convert the file with qw convert and replace the PublicKey of each peer")
+		}
+	}
+	if ni.mtu != 0 && ni.mtu < tunDevMTUIPv6 {
+		for _, prefix := range ni.localEndpoint {
+			if prefix.Addr().Is6() {
+				return errAt(*cp.interfaceLoc, "MTU %d is below %d, the minimum MTU of IPv6 address %s", ni.mtu, tunDevMTUIPv6, prefix)
+			}
+		}
+	}
+
+	identities := make(map[string]location)
+	for i, peer := range qc.peers {
+		loc := cp.peerLocs[i]
+		if ni.usesCA() {
+			if peer.name == "" {
+				return errAt(loc, "peer has no Name")
+			}
+			if peer.publicKey != (PublicKey{}) {
+				return errAt(loc, "peer has a PublicKey, which isn't used with CAFile")
+			}
+		} else {
+			if peer.publicKey == (PublicKey{}) {
+				return errAt(loc, "peer has no PublicKey")
+			}
+			if peer.name != "" {
+				return errAt(loc, "peer has a Name, which is only used with CAFile")
+			}
+			if peer.publicKey == ni.privateKey.PublicKey() {
+				return errAt(loc, "peer has the public key of this node")
+			}
+		}
+		if first, ok := identities[peer.identity()]; ok {
+			return errAt(loc, "duplicate peer %s, first defined at %s", peer.identity(), first)
+		}
+		identities[peer.identity()] = loc
+	}
+
+	owners := make(map[netip.Prefix]int)
+	for i, peer := range qc.peers {
+		for _, prefix := range peer.allowedIPs {
+			if j, ok := owners[prefix]; ok && j != i {
+				return errAt(cp.peerLocs[i], "AllowedIPs %s is already assigned to peer %s at %s",
+					prefix, qc.peers[j].identity(), cp.peerLocs[j])
+			}
+			owners[prefix] = i
+		}
+	}
+	return nil
+}
+
+// parsePort parses a UDP port number
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a port number between 1 and 65535", value)
+	}
+	return port, nil
+}
+
+// validateEndpoint checks that the endpoint is a host or address with a port
+func validateEndpoint(value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("%q has no host", value)
+	}
+	if _, err := parsePort(port); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseMTU parses the MTU of the tunnel interface
+func parseMTU(value string) (int, error) {
+	mtu, err := strconv.Atoi(value)
+	if err != nil || mtu < minMTU || mtu > 65535 {
+		return 0, fmt.Errorf("%q is not an MTU between %d and 65535", value, minMTU)
+	}
+	return mtu, nil
+}
+
+// parseDuration parses a number of seconds, or a duration with a unit such as "1m30s"
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("%q is negative", value)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number of seconds or a duration", value)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%q is negative", value)
+	}
+	return d, nil
+}
+
+// parseKeepalive parses PersistentKeepalive. "off" and 0 disable keepalives
+// and return zero.
+func parseKeepalive(value string) (time.Duration, error) {
+	if value == "off" {
+		return 0, nil
+	}
+	d, err := parseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d > 0 && d < time.Second {
+		return 0, fmt.Errorf("%q is shorter than a second", value)
+	}
+	return d, nil
+}
+
+// parseTimeout parses IdleTimeout and HandshakeTimeout, which must be positive
+func parseTimeout(value string) (time.Duration, error) {
+	d, err := parseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("%q is shorter than a second", value)
+	}
+	return d, nil
+}
@@ -0,0 +1,639 @@
+package quicwire
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testNodeKey  = PrivateKey{1}
+	testPeerKey1 = PrivateKey{2}.PublicKey()
+	testPeerKey2 = PrivateKey{3}.PublicKey()
+)
+
+// expandKeys replaces $KEY, $PEER1 and $PEER2 in a config by the test keys
+func expandKeys(conf string) string {
+	return strings.NewReplacer(
+		"$KEY", testNodeKey.String(),
+		"$PEER1", testPeerKey1.String(),
+		"$PEER2", testPeerKey2.String(),
+	).Replace(conf)
+}
+
+func prefixes(s ...string) []netip.Prefix {
+	var p []netip.Prefix
+	for _, prefix := range s {
+		p = append(p, netip.MustParsePrefix(prefix))
+	}
+	return p
+}
+
+// checkConfig compares the result of parsing a config with the expected
+// config, or with the expected error
+func checkConfig(t *testing.T, qc *QuicConf, err error, want *QuicConf, wantErr *ConfigError) {
+	t.Helper()
+	if wantErr != nil {
+		var confErr *ConfigError
+		if !errors.As(err, &confErr) {
+			t.Fatalf("got error %v, want %v", err, wantErr)
+		}
+		if confErr.File != wantErr.File || confErr.Line != wantErr.Line || confErr.Path != wantErr.Path ||
+			confErr.Err.Error() != wantErr.Err.Error() {
+			t.Fatalf("got error %q, want %q", confErr, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !qc.nodeInterface.equal(&want.nodeInterface) {
+		t.Errorf("got interface %+v, want %+v", qc.nodeInterface, want.nodeInterface)
+	}
+	if len(qc.peers) != len(want.peers) {
+		t.Fatalf("got %d peers, want %d", len(qc.peers), len(want.peers))
+	}
+	for i := range qc.peers {
+		if !qc.peers[i].equal(&want.peers[i]) {
+			t.Errorf("got peer %d %+v, want %+v", i, qc.peers[i], want.peers[i])
+		}
+	}
+}
+
+func lineError(line int, msg string) *ConfigError {
+	return &ConfigError{File: "test.conf", Line: line, Err: errors.New(msg)}
+}
+
+func TestParseQuicConf(t *testing.T) {
+	iface := nodeInterface{
+		listenPort:    55380,
+		localEndpoint: prefixes("10.0.0.1/24"),
+		localNodeIP:   "192.168.1.1",
+		privateKey:    testNodeKey,
+	}
+	peer1 := Peer{publicKey: testPeerKey1, allowedIPs: prefixes("10.0.0.2/32"), endpoint: "192.168.1.2:55380"}
+
+	tests := []struct {
+		name    string
+		conf    string
+		want    *QuicConf
+		wantErr *ConfigError
+	}{
+		{
+			name: "spaces around equals",
+			conf: `
+[Interface]
+LocalEndpoint = 10.0.0.1
+LocalNodeIp = 192.168.1.1
+ListenPort = 55380
+PrivateKey = $KEY
+
+[Peer]
+PublicKey = $PEER1
+AllowedIPs = 10.0.0.2
+Endpoint = 192.168.1.2:55380
+`,
+			want: &QuicConf{nodeInterface: iface, peers: []Peer{peer1}},
+		},
+		{
+			name: "flexible whitespace, case and comments",
+			conf: `
+# node config
+  [ interface ]
+LocalEndpoint=10.0.0.1
+localnodeip	=192.168.1.1   # listen address
+LISTENPORT= 55380
+PrivateKey =$KEY
+[peer]
+	PublicKey   =   $PEER1
+AllowedIPs=10.0.0.2/32
+Endpoint=192.168.1.2:55380
+`,
+			want: &QuicConf{nodeInterface: iface, peers: []Peer{peer1}},
+		},
+		{
+			name: "repeated keys are appended",
+			conf: `
+[Interface]
+LocalEndpoint = 10.0.0.1
+LocalEndpoint = fd00::1
+LocalNodeIp = 192.168.1.1
+ListenPort = 55380
+PrivateKey = $KEY
+IdleTimeout = 1m30s
+PostUp = echo up %i
+PostUp = echo again
+
+[Peer]
+PublicKey = $PEER1
+AllowedIPs = 10.0.0.2, 10.1.0.0/16
+AllowedIPs = fd00::2
+PersistentKeepalive = 25
+`,
+			want: &QuicConf{
+				nodeInterface: nodeInterface{
+					listenPort:    55380,
+					localEndpoint: prefixes("10.0.0.1/24", "fd00::1/64"),
+					localNodeIP:   "192.168.1.1",
+					privateKey:    testNodeKey,
+					idleTimeout:   90 * time.Second,
+					postUp:        []string{"echo up %i", "echo again"},
+				},
+				peers: []Peer{{
+					publicKey:           testPeerKey1,
+					allowedIPs:          prefixes("10.0.0.2/32", "10.1.0.0/16", "fd00::2/128"),
+					persistentKeepalive: 25 * time.Second,
+				}},
+			},
+		},
+		{
+			name: "duplicate key",
+			conf: `[Interface]
+LocalEndpoint = 10.0.0.1
+ListenPort = 55380
+ListenPort = 55381
+`,
+			wantErr: lineError(4, "duplicate key ListenPort in [Interface] section"),
+		},
+		{
+			name: "duplicate peer",
+			conf: `[Interface]
+LocalEndpoint = 10.0.0.1
+LocalNodeIp = 192.168.1.1
+ListenPort = 55380
+PrivateKey = $KEY
+
+[Peer]
+PublicKey = $PEER1
+AllowedIPs = 10.0.0.2
+
+[Peer]
+PublicKey = $PEER1
+AllowedIPs = 10.0.0.3
+`,
+			wantErr: lineError(11, "duplicate peer "+testPeerKey1.String()+", first defined at line 7"),
+		},
+		{
+			name: "AllowedIPs of two peers",
+			conf: `[Interface]
+LocalEndpoint = 10.0.0.1
+LocalNodeIp = 192.168.1.1
+ListenPort = 55380
+PrivateKey = $KEY
+
+[Peer]
+PublicKey = $PEER1
+AllowedIPs = 10.0.0.2
+
+[Peer]
+PublicKey = $PEER2
+AllowedIPs = 10.0.0.2/32
+`,
+			wantErr: lineError(11, "AllowedIPs 10.0.0.2/32 is already assigned to peer "+testPeerKey1.String()+" at line 7"),
+		},
+		{
+			name: "duplicate interface",
+			conf: `[Interface]
+LocalEndpoint = 10.0.0.1
+LocalNodeIp = 192.168.1.1
+ListenPort = 55380
+PrivateKey = $KEY
+[Interface]
+`,
+			wantErr: lineError(6, "duplicate [Interface] section, the first one is at line 1"),
+		},
+		{
+			name:    "unknown section",
+			conf:    "[Interface]\nLocalEndpoint = 10.0.0.1\nLocalNodeIp = 192.168.1.1\nListenPort = 55380\nPrivateKey = $KEY\n[Peers]\n",
+			wantErr: lineError(6, "unknown section [Peers]"),
+		},
+		{
+			name:    "unknown key",
+			conf:    "[Interface]\nListenPort = 55380\nListenAddress = 0.0.0.0\n",
+			wantErr: lineError(3, "unknown key ListenAddress in [Interface] section"),
+		},
+		{
+			name:    "key outside of a section",
+			conf:    "# comment\nListenPort = 55380\n",
+			wantErr: lineError(2, "key ListenPort outside of a section"),
+		},
+		{
+			name:    "line without equals",
+			conf:    "[Interface]\nListenPort 55380\n",
+			wantErr: lineError(2, `expected Key = Value, got "ListenPort 55380"`),
+		},
+		{
+			name:    "unterminated section header",
+			conf:    "[Interface\n",
+			wantErr: lineError(1, `invalid section header "[Interface"`),
+		},
+		{
+			name:    "empty value",
+			conf:    "[Interface]\nListenPort =\n",
+			wantErr: lineError(2, "empty value for ListenPort"),
+		},
+		{
+			name:    "invalid port",
+			conf:    "[Interface]\nListenPort = 70000\n",
+			wantErr: lineError(2, `invalid ListenPort: "70000" is not a port number between 1 and 65535`),
+		},
+		{
+			name:    "invalid address",
+			conf:    "[Interface]\nLocalEndpoint = 10.0.0.300\n",
+			wantErr: lineError(2, "invalid LocalEndpoint: invalid IP address format: 10.0.0.300"),
+		},
+		{
+			name: "invalid endpoint",
+			conf: `[Interface]
+LocalEndpoint = 10.0.0.1
+LocalNodeIp = 192.168.1.1
+ListenPort = 55380
+PrivateKey = $KEY
+
+[Peer]
+Endpoint = 192.168.1.2:0
+`,
+			wantErr: lineError(8, `invalid Endpoint: "0" is not a port number between 1 and 65535`),
+		},
+		{
+			name:    "invalid duration",
+			conf:    "[Interface]\nIdleTimeout = 500ms\n",
+			wantErr: lineError(2, `invalid IdleTimeout: "500ms" is shorter than a second`),
+		},
+		{
+			name:    "missing interface key",
+			conf:    "[Interface]\nLocalEndpoint = 10.0.0.1\nListenPort = 55380\n\n[Peer]\n",
+			wantErr: lineError(1, "[Interface] section has no LocalNodeIp"),
+		},
+		{
+			name: "peer without AllowedIPs",
+			conf: `[Interface]
+LocalEndpoint = 10.0.0.1
+LocalNodeIp = 192.168.1.1
+ListenPort = 55380
+PrivateKey = $KEY
+
+[Peer]
+PublicKey = $PEER1
+`,
+			wantErr: lineError(7, "[Peer] section has no AllowedIPs"),
+		},
+		{
+			name: "peer without PublicKey",
+			conf: `[Interface]
+LocalEndpoint = 10.0.0.1
+LocalNodeIp = 192.168.1.1
+ListenPort = 55380
+PrivateKey = $KEY
+
+[Peer]
+AllowedIPs = 10.0.0.2
+`,
+			wantErr: lineError(7, "peer has no PublicKey"),
+		},
+		{
+			name:    "missing interface section",
+			conf:    "# nothing\n",
+			wantErr: &ConfigError{File: "test.conf", Err: errors.New("missing [Interface] section")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qc := &QuicConf{}
+			err := parseQuicConf(qc, "test.conf", strings.NewReader(expandKeys(tt.conf)))
+			checkConfig(t, qc, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestParseWgQuick(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     string
+		want     *QuicConf
+		warnings []string
+		wantErr  *ConfigError
+	}{
+		{
+			name: "wg-quick file",
+			conf: `[Interface]
+Address = 10.0.0.1/24
+PrivateKey = $KEY
+
+[Peer]
+PublicKey = $PEER1
+AllowedIPs = 10.0.0.2/32
+`,
+			wantErr: lineError(1, "the keys of a wg-quick file are WireGuard keys, which quicwire can't use: "+
+				"convert the file with qw convert and replace the PublicKey of each peer"),
+		},
+		{
+			name: "wg-quick file with a CA",
+			conf: `[Interface]
+Address = 10.0.0.1/24, fd00::1/64
+CAFile = ca.pem
+CertFile = node.pem
+KeyFile = node.key
+DNS = 1.1.1.1
+MTU = 1280
+PostUp = echo up
+PreDown = echo down
+
+[Peer]
+Name = peer1
+PresharedKey = $PEER2
+AllowedIPs = 10.0.0.2/32
+Endpoint = vpn.example.com:51820
+`,
+			want: &QuicConf{
+				nodeInterface: nodeInterface{
+					listenPort:    defaultListenPort,
+					localEndpoint: prefixes("10.0.0.1/24", "fd00::1/64"),
+					localNodeIP:   defaultLocalNodeIP,
+					caFile:        "ca.pem",
+					certFile:      "node.pem",
+					keyFile:       "node.key",
+					mtu:           1280,
+					postUp:        []string{"echo up"},
+					preDown:       []string{"echo down"},
+				},
+				peers: []Peer{{name: "peer1", allowedIPs: prefixes("10.0.0.2/32"), endpoint: "vpn.example.com:51820"}},
+			},
+			warnings: []string{
+				"DNS at line 6 is ignored, quicwire doesn't configure DNS servers",
+				"PresharedKey at line 13 is ignored, connections are only secured by the QUIC handshake",
+			},
+		},
+		{
+			name: "ListenPort and LocalNodeIp given",
+			conf: `[Interface]
+Address = 10.0.0.1
+ListenPort = 51820
+LocalNodeIp = 192.168.1.1
+CAFile = ca.pem
+CertFile = node.pem
+KeyFile = node.key
+SaveConfig = true
+FwMark = 0x1234
+`,
+			want: &QuicConf{nodeInterface: nodeInterface{
+				listenPort:    51820,
+				localEndpoint: prefixes("10.0.0.1/24"),
+				localNodeIP:   "192.168.1.1",
+				caFile:        "ca.pem",
+				certFile:      "node.pem",
+				keyFile:       "node.key",
+			}},
+			warnings: []string{
+				"SaveConfig at line 8 is ignored, quicwire doesn't write the config file",
+				"FwMark at line 9 is ignored, quicwire doesn't mark its packets",
+			},
+		},
+		{
+			name:    "Address and LocalEndpoint",
+			conf:    "[Interface]\nAddress = 10.0.0.1\nLocalEndpoint = 10.0.0.1\nPrivateKey = $KEY\n",
+			wantErr: lineError(1, "[Interface] section has both Address and LocalEndpoint, which are the same setting"),
+		},
+		{
+			name:    "MTU too small for IPv6",
+			conf:    "[Interface]\nAddress = fd00::1\nCAFile = ca.pem\nCertFile = node.pem\nKeyFile = node.key\nMTU = 1200\n",
+			wantErr: lineError(1, "MTU 1200 is below 1280, the minimum MTU of IPv6 address fd00::1/64"),
+		},
+		{
+			name:    "empty ignored key",
+			conf:    "[Interface]\nAddress = 10.0.0.1\nDNS =\n",
+			wantErr: lineError(3, "empty value for DNS"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qc := &QuicConf{}
+			err := parseQuicConf(qc, "test.conf", strings.NewReader(expandKeys(tt.conf)))
+			checkConfig(t, qc, err, tt.want, tt.wantErr)
+			if tt.wantErr != nil {
+				return
+			}
+			if len(qc.warnings) != len(tt.warnings) {
+				t.Fatalf("got warnings %q, want %q", qc.warnings, tt.warnings)
+			}
+			for i, w := range tt.warnings {
+				if !strings.HasPrefix(qc.warnings[i], w) {
+					t.Errorf("got warning %q, want %q", qc.warnings[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertWgQuick(t *testing.T) {
+	conf := expandKeys(`[Interface]
+# tunnel address
+Address = 10.0.0.1/24
+PrivateKey = $KEY
+DNS = 1.1.1.1
+
+[Peer]
+PublicKey = $PEER1
+PresharedKey = $PEER2
+AllowedIPs = 10.0.0.2/32
+`)
+	var out bytes.Buffer
+	if err := ConvertWgQuick("wg0.conf", strings.NewReader(conf), &out); err != nil {
+		t.Fatalf("ConvertWgQuick: %v", err)
+	}
+	converted := out.String()
+	for _, want := range []string{
+		"# tunnel address\n",
+		"LocalEndpoint = 10.0.0.1/24\n",
+		"LocalNodeIp = 0.0.0.0\n",
+		"ListenPort = 55380\n",
+		"# DNS = 1.1.1.1  (ignored, quicwire doesn't configure DNS servers)\n",
+		"# PresharedKey removed",
+		"# WireGuard PublicKey " + testPeerKey1.String() + ", replace the placeholder",
+		"PublicKey = " + peerKeyPlaceholder + "\n",
+	} {
+		if !strings.Contains(converted, want) {
+			t.Errorf("converted config lacks %q:\n%s", want, converted)
+		}
+	}
+	for _, secret := range []string{testNodeKey.String(), testPeerKey2.String()} {
+		if strings.Contains(converted, secret) {
+			t.Errorf("converted config kept the WireGuard key %s", secret)
+		}
+	}
+
+	// The config is rejected until the placeholder is replaced
+	err := parseQuicConf(&QuicConf{}, "test.conf", strings.NewReader(converted))
+	checkConfig(t, nil, err, nil, lineError(13, "invalid PublicKey: the placeholder left by qw convert must be replaced with the quicwire public key of the peer"))
+
+	qc := &QuicConf{}
+	converted = strings.Replace(converted, peerKeyPlaceholder, testPeerKey1.String(), 1)
+	if err := parseQuicConf(qc, "converted.conf", strings.NewReader(converted)); err != nil {
+		t.Fatalf("converted config is invalid: %v", err)
+	}
+	if len(qc.warnings) != 0 {
+		t.Errorf("converted config has warnings %q", qc.warnings)
+	}
+	// The node gets a new key, which the comment names
+	if qc.nodeInterface.privateKey == testNodeKey {
+		t.Errorf("converted config kept the WireGuard PrivateKey")
+	}
+	if want := "the public key of this node is " + qc.nodeInterface.privateKey.PublicKey().String(); !strings.Contains(converted, want) {
+		t.Errorf("converted config lacks %q", want)
+	}
+
+	native := expandKeys("[Interface]\nLocalEndpoint = 10.0.0.1\nLocalNodeIp = 0.0.0.0\nListenPort = 55380\nPrivateKey = $KEY\n")
+	err = ConvertWgQuick("quicwire.conf", strings.NewReader(native), &out)
+	checkConfig(t, nil, err, nil, &ConfigError{File: "quicwire.conf",
+		Err: errors.New("not a wg-quick file, its [Interface] section has no Address")})
+}
+
+func TestReadStructuredConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		conf    string
+		want    *QuicConf
+		wantErr *ConfigError
+	}{
+		{
+			name: "json",
+			file: "quicwire.json",
+			conf: `{
+  "interface": {"localEndpoint": ["10.0.0.1/24"], "localNodeIp": "192.168.1.1", "listenPort": 55380, "privateKey": "$KEY", "idleTimeout": 60},
+  "peers": [{"publicKey": "$PEER1", "allowedIPs": ["10.0.0.2"], "endpoint": "192.168.1.2:55380", "persistentKeepalive": "25s"}]
+}`,
+			want: &QuicConf{
+				nodeInterface: nodeInterface{
+					listenPort:    55380,
+					localEndpoint: prefixes("10.0.0.1/24"),
+					localNodeIP:   "192.168.1.1",
+					privateKey:    testNodeKey,
+					idleTimeout:   time.Minute,
+				},
+				peers: []Peer{{publicKey: testPeerKey1, allowedIPs: prefixes("10.0.0.2/32"), endpoint: "192.168.1.2:55380",
+					persistentKeepalive: 25 * time.Second}},
+			},
+		},
+		{
+			name: "yaml",
+			file: "quicwire.yaml",
+			conf: `interface:
+  localEndpoint: [10.0.0.1/24]
+  localNodeIp: 192.168.1.1
+  listenPort: 55380
+  privateKey: $KEY
+peers:
+  - publicKey: $PEER1
+    allowedIPs: [10.0.0.2]
+    endpoint: 192.168.1.2:55380
+`,
+			want: &QuicConf{
+				nodeInterface: nodeInterface{
+					listenPort:    55380,
+					localEndpoint: prefixes("10.0.0.1/24"),
+					localNodeIP:   "192.168.1.1",
+					privateKey:    testNodeKey,
+				},
+				peers: []Peer{{publicKey: testPeerKey1, allowedIPs: prefixes("10.0.0.2/32"), endpoint: "192.168.1.2:55380"}},
+			},
+		},
+		{
+			name: "json invalid list item",
+			file: "quicwire.json",
+			conf: `{"interface": {"localEndpoint": ["10.0.0.1", "10.0.0"], "localNodeIp": "192.168.1.1", "listenPort": 55380, "privateKey": "$KEY"}}`,
+			wantErr: &ConfigError{File: "quicwire.json", Path: "interface.localEndpoint[1]",
+				Err: errors.New("invalid LocalEndpoint: invalid IP address format: 10.0.0")},
+		},
+		{
+			name: "yaml invalid peer setting",
+			file: "quicwire.yml",
+			conf: `interface:
+  localEndpoint: [10.0.0.1]
+  localNodeIp: 192.168.1.1
+  listenPort: 55380
+  privateKey: $KEY
+peers:
+  - publicKey: $PEER1
+    allowedIPs: [10.0.0.2]
+  - publicKey: $PEER2
+    allowedIPs: [10.0.0.3]
+    endpoint: 192.168.1.3
+`,
+			wantErr: &ConfigError{File: "quicwire.yml", Path: "peers[1].endpoint",
+				Err: errors.New("invalid Endpoint: address 192.168.1.3: missing port in address")},
+		},
+		{
+			name: "yaml duplicate peer",
+			file: "quicwire.yaml",
+			conf: `interface:
+  localEndpoint: [10.0.0.1]
+  localNodeIp: 192.168.1.1
+  listenPort: 55380
+  privateKey: $KEY
+peers:
+  - publicKey: $PEER1
+    allowedIPs: [10.0.0.2]
+  - publicKey: $PEER1
+    allowedIPs: [10.0.0.3]
+`,
+			wantErr: &ConfigError{File: "quicwire.yaml", Path: "peers[1]",
+				Err: errors.New("duplicate peer " + testPeerKey1.String() + ", first defined at peers[0]")},
+		},
+		{
+			name: "json missing interface setting",
+			file: "quicwire.json",
+			conf: `{"interface": {"localEndpoint": ["10.0.0.1"], "listenPort": 55380, "privateKey": "$KEY"}}`,
+			wantErr: &ConfigError{File: "quicwire.json", Path: "interface",
+				Err: errors.New("[Interface] section has no LocalNodeIp")},
+		},
+		{
+			name: "json unknown field",
+			file: "quicwire.json",
+			conf: `{"interface": {"listenAddress": "0.0.0.0"}}`,
+			wantErr: &ConfigError{File: "quicwire.json",
+				Err: errors.New(`json: unknown field "listenAddress"`)},
+		},
+		{
+			name:    "empty json",
+			file:    "quicwire.json",
+			conf:    "",
+			wantErr: &ConfigError{File: "quicwire.json", Err: errors.New("empty config file")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(expandKeys(tt.conf)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != nil {
+				tt.wantErr.File = path
+			}
+			qc := &QuicConf{}
+			err := readQuicConf(qc, path)
+			checkConfig(t, qc, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestConfigErrorString(t *testing.T) {
+	tests := []struct {
+		err  *ConfigError
+		want string
+	}{
+		{lineError(3, "bad"), "test.conf:3: bad"},
+		{&ConfigError{File: "q.yaml", Path: "peers[0].endpoint", Err: errors.New("bad")}, "q.yaml: peers[0].endpoint: bad"},
+		{&ConfigError{File: "q.json", Err: errors.New("bad")}, "q.json: bad"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
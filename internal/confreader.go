@@ -1,32 +1,127 @@
 package quicwire
 
 import (
-	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Peer represents a peer in the quicwire configuration file
 type Peer struct {
-	allowedIPs          []string
+	allowedIPs          []netip.Prefix
 	endpoint            string
-	persistentKeepalive string
+	persistentKeepalive time.Duration
+	publicKey           PublicKey
+	name                string
+}
+
+// identity returns the name that authenticates the peer: its certificate name
+// when a CA is used, its public key otherwise
+func (p *Peer) identity() string {
+	if p.name != "" {
+		return p.name
+	}
+	return p.publicKey.String()
+}
+
+// equal reports whether both peers have the same configuration
+func (p *Peer) equal(o *Peer) bool {
+	return p.endpoint == o.endpoint &&
+		p.persistentKeepalive == o.persistentKeepalive &&
+		p.publicKey == o.publicKey &&
+		p.name == o.name &&
+		equalPrefixes(p.allowedIPs, o.allowedIPs)
+}
+
+func equalPrefixes(a, b []netip.Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // nodeInterface represents the node interface in the quicwire configuration file
 type nodeInterface struct {
 	listenPort    int
-	localEndpoint string
+	localEndpoint []netip.Prefix
 	localNodeIP   string
+	privateKey    PrivateKey
+	caFile        string
+	certFile      string
+	keyFile       string
+	table         int
+	// idleTimeout and handshakeTimeout of the QUIC connections, zero uses the QUIC defaults
+	idleTimeout      time.Duration
+	handshakeTimeout time.Duration
+	// mtu of the tunnel interface, zero picks it from the tunneled address families
+	mtu int
+	// Commands run around the setup and teardown of the tunnel interface, like wg-quick hooks
+	preUp    []string
+	postUp   []string
+	preDown  []string
+	postDown []string
+}
+
+// usesCA reports whether peers are authenticated with certificates issued by a CA
+// rather than with pinned public keys
+func (ni *nodeInterface) usesCA() bool {
+	return ni.caFile != ""
+}
+
+// equal reports whether both interfaces have the same configuration
+func (ni *nodeInterface) equal(o *nodeInterface) bool {
+	return ni.listenPort == o.listenPort &&
+		equalPrefixes(ni.localEndpoint, o.localEndpoint) &&
+		ni.localNodeIP == o.localNodeIP &&
+		ni.privateKey == o.privateKey &&
+		ni.caFile == o.caFile &&
+		ni.certFile == o.certFile &&
+		ni.keyFile == o.keyFile &&
+		ni.table == o.table &&
+		ni.idleTimeout == o.idleTimeout &&
+		ni.handshakeTimeout == o.handshakeTimeout &&
+		ni.mtu == o.mtu &&
+		equalStrings(ni.preUp, o.preUp) &&
+		equalStrings(ni.postUp, o.postUp) &&
+		equalStrings(ni.preDown, o.preDown) &&
+		equalStrings(ni.postDown, o.postDown)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // QuicConf contains the quicwire configuration file data
 type QuicConf struct {
 	nodeInterface nodeInterface
 	peers         []Peer
+	// warnings about settings of the file that are ignored
+	warnings []string
 }
 
+// readQuicConf reads and validates the config file. Its format is picked from
+// the extension: JSON for .json, YAML for .yaml and .yml, INI otherwise.
 func readQuicConf(qc *QuicConf, configFile string) error {
 	file, err := os.Open(configFile)
 	if err != nil {
@@ -34,95 +129,145 @@ func readQuicConf(qc *QuicConf, configFile string) error {
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-
-	// Variables to store values from the file
-	var section, localEndpoint, localNodeIP, endpoint, persistentKeepalive string
-	var listenPort int
-	var allowedIPs []string
+	var conf Config
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".json":
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&conf)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		err = decoder.Decode(&conf)
+	default:
+		return parseQuicConf(qc, configFile, file)
+	}
+	if errors.Is(err, io.EOF) {
+		return &ConfigError{File: configFile, Err: fmt.Errorf("empty config file")}
+	}
+	if err != nil {
+		return &ConfigError{File: configFile, Err: err}
+	}
+	return parseConfig(qc, configFile, &conf)
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Trim any leading or trailing spaces from the line
-		line = strings.TrimSpace(line)
+// CheckConfig reads and validates the config file without applying it. It
+// returns the number of peers and warnings about settings that are valid but
+// likely mistakes.
+func CheckConfig(configFile string) (int, []string, error) {
+	qc := &QuicConf{}
+	if err := readQuicConf(qc, configFile); err != nil {
+		return 0, nil, err
+	}
+	warnings := qc.warnings
+	for _, o := range qc.allowedIPOverlaps() {
+		warnings = append(warnings, fmt.Sprintf("AllowedIPs %s of peer %s overlaps %s of peer %s, the longest prefix wins",
+			o.prefix, o.peer, o.otherPrefix, o.otherPeer))
+	}
+	idleTimeout := qc.nodeInterface.idleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	for _, peer := range qc.peers {
+		if peer.persistentKeepalive >= idleTimeout {
+			warnings = append(warnings, fmt.Sprintf("PersistentKeepalive %s of peer %s is not shorter than the idle timeout %s",
+				peer.persistentKeepalive, peer.identity(), idleTimeout))
+		}
+	}
+	return len(qc.peers), warnings, nil
+}
 
-		// Ignore any comments or empty lines
-		if len(line) == 0 || line[0] == '#' {
+// ParseAllowedIPs parses a comma separated list of CIDRs. Plain addresses
+// are treated as host prefixes.
+func ParseAllowedIPs(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
 			continue
 		}
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
 
-		// Check if the line starts with a section header
-		if line[0] == '[' && line[len(line)-1] == ']' {
-			if section != "" && section == "Interface" {
-				qc.nodeInterface.listenPort = listenPort
-				qc.nodeInterface.localNodeIP = localNodeIP
-				qc.nodeInterface.localEndpoint = localEndpoint
-			}
-
-			if section != "" && section == "Peer" {
-				qc.peers = append(qc.peers, Peer{
-					allowedIPs:          allowedIPs,
-					endpoint:            endpoint,
-					persistentKeepalive: persistentKeepalive,
-				})
-			}
-
-			// Extract the section name and print it
-			section = line[1 : len(line)-1]
-
-			// Reset variables for new section
-			allowedIPs = nil
-
-		} else {
-			// Split the line into key and value parts
-			parts := strings.Split(line, " = ")
-			if len(parts) != 2 {
-				continue
-			}
-
-			// Extract the key and value
-			key := parts[0]
-			value := parts[1]
-
-			// Store the values in the corresponding variables
-			switch key {
-			case "ListenPort":
-				listenPort, err = strconv.Atoi(value)
-				if err != nil {
-					return err
-				}
-			case "LocalEndpoint":
-				localEndpoint = value
-			case "LocalNodeIp":
-				localNodeIP = value
-			case "AllowedIPs":
-				allowedIPs = strings.Split(value, ",")
-			case "Endpoint":
-				endpoint = value
-			case "PersistentKeepalive":
-				persistentKeepalive = value
-			default:
+// parseInterfaceAddresses parses a comma separated list of tunnel interface
+// addresses. Plain addresses get a /24 prefix for IPv4 or a /64 prefix for
+// IPv6, for convenience of not having to add a route for the tunnel subnet.
+func parseInterfaceAddresses(value string) ([]netip.Prefix, error) {
+	var addresses []netip.Prefix
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
 			}
+			addresses = append(addresses, prefix)
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address format: %s", s)
+		}
+		bits := 24
+		if addr.Is6() {
+			bits = 64
+		}
+		addresses = append(addresses, netip.PrefixFrom(addr, bits))
+	}
+	return addresses, nil
+}
 
+// parsePrefix parses a CIDR or a plain address as a host prefix
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: %w", s, err)
 		}
+		return prefix.Masked(), nil
 	}
-	if section != "" && section == "Interface" {
-		qc.nodeInterface.listenPort = listenPort
-		qc.nodeInterface.localNodeIP = localNodeIP
-		qc.nodeInterface.localEndpoint = localEndpoint
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q: %w", s, err)
 	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
 
-	if section != "" && section == "Peer" {
-		qc.peers = append(qc.peers, Peer{
-			allowedIPs:          allowedIPs,
-			endpoint:            endpoint,
-			persistentKeepalive: persistentKeepalive,
-		})
-	}
+// prefixOverlap describes AllowedIPs of two different peers that overlap
+type prefixOverlap struct {
+	peer        string
+	prefix      netip.Prefix
+	otherPeer   string
+	otherPrefix netip.Prefix
+}
 
-	if err := scanner.Err(); err != nil {
-		return err
+// allowedIPOverlaps returns every pair of overlapping AllowedIPs that belong to different peers
+func (qc *QuicConf) allowedIPOverlaps() []prefixOverlap {
+	var overlaps []prefixOverlap
+	for i := range qc.peers {
+		for j := i + 1; j < len(qc.peers); j++ {
+			for _, a := range qc.peers[i].allowedIPs {
+				for _, b := range qc.peers[j].allowedIPs {
+					if a.Overlaps(b) {
+						overlaps = append(overlaps, prefixOverlap{
+							peer:        qc.peers[i].identity(),
+							prefix:      a,
+							otherPeer:   qc.peers[j].identity(),
+							otherPrefix: b,
+						})
+					}
+				}
+			}
+		}
 	}
-
-	return nil
+	return overlaps
 }
@@ -0,0 +1,157 @@
+package quicwire
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultControlSocket is the path of the control socket of the node
+	DefaultControlSocket = "/var/run/quicwire.sock"
+	// controlTimeout bounds a request over the control socket
+	controlTimeout = 10 * time.Second
+)
+
+// controlRequest is a request sent over the control socket, one per connection
+type controlRequest struct {
+	Command string      `json:"command"`
+	Peer    *PeerUpdate `json:"peer,omitempty"`
+}
+
+// controlResponse answers a controlRequest
+type controlResponse struct {
+	Error  string           `json:"error,omitempty"`
+	Status *InterfaceStatus `json:"status,omitempty"`
+}
+
+// listenControl listens on the control socket until the node stops. The
+// socket is only accessible to the user running the node.
+func (qn *QuicWire) listenControl() (net.Listener, error) {
+	// A node answering on the socket is still running. A socket nobody
+	// answers on was left behind by a node that didn't stop cleanly, and
+	// blocks the listener until it is removed.
+	conn, err := net.DialTimeout("unix", qn.controlSocket, time.Second)
+	if err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use, quicwire is already running", qn.controlSocket)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		if err := os.Remove(qn.controlSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+		}
+	}
+	listener, err := listenControlSocket(qn.controlSocket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(qn.controlSocket, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+
+	qn.wg.Add(1)
+	go func() {
+		defer qn.wg.Done()
+		<-qn.ctx.Done()
+		// Closing the listener also removes the socket
+		listener.Close()
+	}()
+	return listener, nil
+}
+
+// serveControl accepts requests on the control socket until the node stops
+func (qn *QuicWire) serveControl(listener net.Listener) {
+	qn.logger.Infof("Listening for control requests on %s", qn.controlSocket)
+	qn.wg.Add(1)
+	go func() {
+		defer qn.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if qn.ctx.Err() == nil {
+					qn.logger.Errorf("Failed to accept control connection: %v", err)
+				}
+				return
+			}
+			qn.handleControl(conn)
+		}
+	}()
+}
+
+// handleControl answers a single request received over conn
+func (qn *QuicWire) handleControl(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req controlRequest
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if err := qn.control(req, &resp); err != nil {
+		resp.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		qn.logger.Debugf("Failed to answer control request: %v", err)
+	}
+}
+
+// control runs a control request
+func (qn *QuicWire) control(req controlRequest, resp *controlResponse) error {
+	switch req.Command {
+	case "show":
+		status := qn.Status()
+		resp.Status = &status
+		return nil
+	case "set":
+		if req.Peer == nil {
+			return fmt.Errorf("set request without peer")
+		}
+		return qn.SetPeer(*req.Peer)
+	}
+	return fmt.Errorf("unknown command %q", req.Command)
+}
+
+// controlCall sends a request to the node listening on the control socket
+func controlCall(socket string, req controlRequest) (*controlResponse, error) {
+	conn, err := net.DialTimeout("unix", socket, controlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(&req); err != nil {
+		return nil, fmt.Errorf("failed to send control request: %w", err)
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read control response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// ControlShow returns the status of the node listening on the control socket
+func ControlShow(socket string) (*InterfaceStatus, error) {
+	resp, err := controlCall(socket, controlRequest{Command: "show"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return nil, fmt.Errorf("control response without status")
+	}
+	return resp.Status, nil
+}
+
+// ControlSetPeer changes a peer of the node listening on the control socket
+func ControlSetPeer(socket string, update PeerUpdate) error {
+	_, err := controlCall(socket, controlRequest{Command: "set", Peer: &update})
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package quicwire
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenControlSocket listens on the unix socket at path. The socket is created
+// accessible to the user running the node only, other users can't connect
+// before its permissions are set.
+func listenControlSocket(path string) (net.Listener, error) {
+	umask := syscall.Umask(0o077)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package quicwire
+
+import "net"
+
+// listenControlSocket listens on the unix socket at path
+func listenControlSocket(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,217 @@
+package quicwire
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// deviceBatch is the largest number of packets moved by a single read or
+	// write of the device
+	deviceBatch = 128
+	// peerQueueLen is the number of packets queued for a peer. Packets read
+	// while the queue is full are dropped, like a NIC drops them when its
+	// transmit ring is full.
+	peerQueueLen = 1024
+	// deviceQueueLen is the number of packets received from the peers that
+	// wait to be written to the device
+	deviceQueueLen = 1024
+)
+
+// packetBuf is a buffer of the packet pool holding a single packet
+type packetBuf struct {
+	data []byte
+	n    int
+}
+
+// packet returns the packet held by the buffer
+func (b *packetBuf) packet() []byte {
+	return b.data[:b.n]
+}
+
+// packetPool recycles the buffers of the packets forwarded by the node, so
+// the dataplane doesn't allocate per packet. Buffers hold a packet of the
+// MTU of the device and a spare byte, which is only filled by a device that
+// returns a larger packet truncated to the buffer.
+type packetPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newPacketPool(size int) *packetPool {
+	p := &packetPool{size: size}
+	p.pool.New = func() any {
+		return &packetBuf{data: make([]byte, size+1)}
+	}
+	return p
+}
+
+// get returns an empty buffer of the pool
+func (p *packetPool) get() *packetBuf {
+	b := p.pool.Get().(*packetBuf)
+	b.n = 0
+	return b
+}
+
+// put returns a buffer to the pool once its packet is forwarded
+func (p *packetPool) put(b *packetBuf) {
+	if b == nil || len(b.data) != p.size+1 {
+		return
+	}
+	p.pool.Put(b)
+}
+
+// devicePacket is a packet received from a peer that waits to be written to
+// the device. buf holds the packet when it comes from the pool.
+type devicePacket struct {
+	data []byte
+	buf  *packetBuf
+}
+
+// forwardFromDevice reads batches of packets from the device and queues each
+// of them for the peer owning its destination until the node stops. The
+// buffers of queued packets are handed to the sender of the peer and replaced
+// from the pool.
+func (qn *QuicWire) forwardFromDevice() {
+	bufs := make([]*packetBuf, deviceBatch)
+	data := make([][]byte, deviceBatch)
+	sizes := make([]int, deviceBatch)
+	for i := range bufs {
+		bufs[i] = qn.pool.get()
+		data[i] = bufs[i].data
+	}
+	defer func() {
+		for _, b := range bufs {
+			qn.pool.put(b)
+		}
+	}()
+
+	for {
+		n, err := qn.localIf.ReadBatch(data, sizes)
+		for i := 0; i < n; i++ {
+			packet := data[i][:sizes[i]]
+			// Packets larger than the MTU are truncated by the read, they
+			// fill the spare byte of the buffer or are shorter than their
+			// IP header says
+			if len(packet) > qn.pool.size {
+				continue
+			}
+			if length, ok := packetLength(packet); !ok || length != len(packet) {
+				continue
+			}
+			dstIP, ok := packetDestination(packet)
+			if !ok {
+				continue
+			}
+			peer := qn.peers.lookup(dstIP)
+			if peer == nil {
+				continue
+			}
+			bufs[i].n = sizes[i]
+			if peer.enqueue(bufs[i]) {
+				bufs[i] = qn.pool.get()
+				data[i] = bufs[i].data
+			}
+		}
+		if err != nil {
+			if qn.ctx.Err() != nil {
+				return
+			}
+			qn.fail(fmt.Errorf("failed to read packet from TUN interface: %w", err))
+			return
+		}
+	}
+}
+
+// sendToPeer sends the packets queued for the peer over its connection until
+// the peer is removed or the node stops. Each peer has its own sender, so a
+// slow or congested peer doesn't hold back the packets of the others.
+func (qn *QuicWire) sendToPeer(p *peerState) {
+	defer func() {
+		for {
+			select {
+			case b := <-p.queue:
+				qn.pool.put(b)
+			default:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case b := <-p.queue:
+			err := p.send(b.packet())
+			qn.pool.put(b)
+			if errors.Is(err, errNoConnection) {
+				p.stats.droppedPackets.Add(1)
+			} else if err != nil && p.ctx.Err() == nil {
+				qn.logger.Debugf("Failed to send packet to peer %s: %v", p.identity(), err)
+				p.stats.droppedPackets.Add(1)
+			}
+		}
+	}
+}
+
+// writeToDevice writes the packets received from the peers to the device
+// until the node stops. The packets waiting when a write ends are written
+// together by the next one.
+func (qn *QuicWire) writeToDevice() {
+	pending := make([]devicePacket, 0, deviceBatch)
+	packets := make([][]byte, 0, deviceBatch)
+	for {
+		select {
+		case <-qn.ctx.Done():
+			return
+		case p := <-qn.deviceQueue:
+			pending = append(pending, p)
+		}
+	collect:
+		for len(pending) < deviceBatch {
+			select {
+			case p := <-qn.deviceQueue:
+				pending = append(pending, p)
+			default:
+				break collect
+			}
+		}
+
+		for _, p := range pending {
+			packets = append(packets, p.data)
+		}
+		for batch := packets; len(batch) > 0; {
+			n, err := qn.localIf.WriteBatch(batch)
+			if err == nil {
+				break
+			}
+			if qn.ctx.Err() != nil {
+				return
+			}
+			// The packet that failed is dropped, the rest of the batch is still written
+			qn.logger.Errorf("Failed to write packet to TUN interface: %v", err)
+			if n >= len(batch) {
+				break
+			}
+			batch = batch[n+1:]
+		}
+		for i, p := range pending {
+			qn.pool.put(p.buf)
+			pending[i] = devicePacket{}
+			packets[i] = nil
+		}
+		pending = pending[:0]
+		packets = packets[:0]
+	}
+}
+
+// writeDevice queues a packet received from a peer to be written to the device
+func (qn *QuicWire) writeDevice(data []byte, buf *packetBuf) {
+	select {
+	case qn.deviceQueue <- devicePacket{data: data, buf: buf}:
+	case <-qn.ctx.Done():
+		qn.pool.put(buf)
+	}
+}
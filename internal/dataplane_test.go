@@ -0,0 +1,214 @@
+package quicwire
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// benchWindow is the number of packets in flight in the dataplane benchmarks.
+// It is below the queues of the MemoryDevice and of the node, so the node
+// never drops packets because the benchmark sends too fast.
+const benchWindow = 128
+
+// benchLossTimeout is the time after which the packets in flight are lost
+const benchLossTimeout = 100 * time.Millisecond
+
+// runWindow injects b.N packets with inject while at most window of them are
+// in flight, like a TCP sender, and waits for each of them on out. release
+// is called with each packet received. It reports the packets per second and
+// returns the number of packets that never arrived.
+func runWindow[T any](b *testing.B, window int, inject func(), out <-chan T, release func(T)) int {
+	timer := time.NewTimer(benchLossTimeout)
+	defer timer.Stop()
+	sent, done, inFlight, lost := 0, 0, 0, 0
+	b.ResetTimer()
+	for done < b.N {
+		for inFlight < window && sent < b.N {
+			inject()
+			sent++
+			inFlight++
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(benchLossTimeout)
+		select {
+		case p := <-out:
+			release(p)
+			done++
+			inFlight--
+		case <-timer.C:
+			lost += inFlight
+			done += inFlight
+			inFlight = 0
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+	return lost
+}
+
+// benchPacket returns a packet of size bytes from 10.99.0.1 or fd99::1 to
+// 10.99.0.2 or fd99::2, IPv6 for packets that don't fit a datagram
+func benchPacket(size int) []byte {
+	if size > maxDatagramSize {
+		return udpPacket(netip.MustParseAddr("fd99::1"), netip.MustParseAddr("fd99::2"), size-48)
+	}
+	return udpPacket(netip.MustParseAddr("10.99.0.1"), netip.MustParseAddr("10.99.0.2"), size-28)
+}
+
+var benchSizes = []int{64, 512, 1190, 1280}
+
+// newBenchNode returns a node with a MemoryDevice and the dataplane queues,
+// without connections, whose goroutines are started by the benchmark. The
+// MemoryDevice copies each packet injected or written, which is one of the
+// allocations per packet reported.
+func newBenchNode(b *testing.B) (*QuicWire, *MemoryDevice) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dev := NewMemoryDevice("mem", tunDevMTUIPv6)
+	qn := &QuicWire{
+		logger:      zap.NewNop().Sugar(),
+		peers:       newPeerRegistry(),
+		localIf:     dev,
+		pool:        newPacketPool(dev.MTU()),
+		deviceQueue: make(chan devicePacket, deviceQueueLen),
+	}
+	qn.ctx, qn.cancel = ctx, cancel
+	return qn, dev
+}
+
+// runDataplane runs f in a goroutine until the benchmark ends
+func runDataplane(b *testing.B, qn *QuicWire, dev *MemoryDevice, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	b.Cleanup(func() {
+		qn.cancel()
+		dev.Close()
+		<-done
+	})
+}
+
+func BenchmarkForwardFromDevice(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			qn, dev := newBenchNode(b)
+			p := newPeerState(qn.ctx, Peer{
+				publicKey:  PrivateKey{2}.PublicKey(),
+				allowedIPs: prefixes("10.99.0.2/32", "fd99::2/128"),
+			})
+			// The peer looks connected, its queue is read by the benchmark
+			p.client.Store(&Client{})
+			if err := qn.peers.add(p); err != nil {
+				b.Fatal(err)
+			}
+			runDataplane(b, qn, dev, qn.forwardFromDevice)
+
+			packet := benchPacket(size)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			lost := runWindow(b, benchWindow, func() { _ = dev.Inject(packet) }, p.queue, qn.pool.put)
+			if lost != 0 || p.stats.droppedPackets.Load() != 0 {
+				b.Fatalf("%d packets lost", lost)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteToDevice(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			qn, dev := newBenchNode(b)
+			runDataplane(b, qn, dev, qn.writeToDevice)
+
+			packet := benchPacket(size)
+			write := func() {
+				buf := qn.pool.get()
+				buf.n = copy(buf.data, packet)
+				qn.writeDevice(buf.packet(), buf)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			lost := runWindow(b, benchWindow, write, dev.Outbound(), func([]byte) {})
+			if lost != 0 {
+				b.Fatalf("%d packets lost", lost)
+			}
+		})
+	}
+}
+
+func BenchmarkFragmentReassemble(b *testing.B) {
+	for _, size := range []int{1190, 1280, 4000} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			var f fragmenter
+			// The pool holds packets of the size, as a device of that MTU
+			pool := newPacketPool(size)
+			r := newReassembler(pool)
+			packet := testPacket(size)
+			scratch := make([]byte, maxDatagramSize)
+			// The datagrams are copied, as the QUIC connection does on send
+			datagrams := make([][]byte, maxFragments)
+			for i := range datagrams {
+				datagrams[i] = make([]byte, maxDatagramSize)
+			}
+			var count int
+			send := func(d []byte) error {
+				datagrams[count] = datagrams[count][:copy(datagrams[count][:cap(datagrams[count])], d)]
+				count++
+				return nil
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				count = 0
+				if err := f.fragment(packet, scratch, send); err != nil {
+					b.Fatal(err)
+				}
+				var got []byte
+				for _, d := range datagrams[:count] {
+					p, buf, err := r.add(d)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if p != nil {
+						got = p
+						pool.put(buf)
+					}
+				}
+				if len(got) != size {
+					b.Fatalf("reassembled %d bytes, want %d", len(got), size)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
+
+// BenchmarkTunnel forwards packets between two nodes connected over QUIC on
+// the loopback interface: from the device of the first one through its peer
+// sender and the QUIC connection, to the device of the second one
+func BenchmarkTunnel(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			a, peer := startPair(b)
+			packet := benchPacket(size)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			lost := runWindow(b, benchWindow, func() { _ = a.dev.Inject(packet) }, peer.dev.Outbound(), func([]byte) {})
+			b.ReportMetric(float64(lost)*100/float64(b.N), "%lost")
+		})
+	}
+}
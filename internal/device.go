@@ -0,0 +1,145 @@
+package quicwire
+
+import (
+	"os"
+	"sync"
+)
+
+// memoryDeviceQueue is the number of packets queued in each direction of a MemoryDevice
+const memoryDeviceQueue = 256
+
+// Device is the packet device of the tunnel. Each read or write carries a
+// single IP packet. The node creates a TUN interface unless a device is given
+// to UseDevice.
+type Device interface {
+	// Name returns the name of the interface
+	Name() string
+	// MTU returns the largest packet the device carries
+	MTU() int
+	// Read reads a packet into buf and returns its size
+	Read(buf []byte) (int, error)
+	// Write writes a packet
+	Write(packet []byte) (int, error)
+	// ReadBatch reads at least one and at most len(bufs) packets, storing
+	// the size of each in sizes, and returns the number of packets read.
+	// Each buffer holds at least MTU bytes.
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+	// WriteBatch writes the packets and returns the number written. The
+	// packets are reused once it returns, so they must not be kept.
+	WriteBatch(packets [][]byte) (int, error)
+	// Close closes the device, which ends pending reads
+	Close() error
+}
+
+// MemoryDevice is a Device in memory, which lets a node run without a TUN
+// interface, such as in tests. Packets passed to Inject are read by the node,
+// and the packets written by the node are delivered on Outbound. Packets the
+// node writes while the Outbound queue is full are dropped, like a TUN
+// interface drops them when its queue is full.
+type MemoryDevice struct {
+	name      string
+	mtu       int
+	inbound   chan []byte
+	outbound  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryDevice creates a device in memory
+func NewMemoryDevice(name string, mtu int) *MemoryDevice {
+	return &MemoryDevice{
+		name:     name,
+		mtu:      mtu,
+		inbound:  make(chan []byte, memoryDeviceQueue),
+		outbound: make(chan []byte, memoryDeviceQueue),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Name returns the name of the device
+func (d *MemoryDevice) Name() string {
+	return d.name
+}
+
+// MTU returns the MTU of the device
+func (d *MemoryDevice) MTU() int {
+	return d.mtu
+}
+
+// Inject queues a packet to be read by the node, it blocks while the queue is full
+func (d *MemoryDevice) Inject(packet []byte) error {
+	select {
+	case d.inbound <- append([]byte(nil), packet...):
+		return nil
+	case <-d.closed:
+		return os.ErrClosed
+	}
+}
+
+// Outbound returns the packets written by the node
+func (d *MemoryDevice) Outbound() <-chan []byte {
+	return d.outbound
+}
+
+// Read reads a packet injected with Inject
+func (d *MemoryDevice) Read(buf []byte) (int, error) {
+	select {
+	case packet := <-d.inbound:
+		return copy(buf, packet), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+// ReadBatch reads the packets injected with Inject, waiting for the first one
+func (d *MemoryDevice) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n, err := d.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	count := 1
+	for count < len(bufs) {
+		select {
+		case packet := <-d.inbound:
+			sizes[count] = copy(bufs[count], packet)
+			count++
+		default:
+			return count, nil
+		}
+	}
+	return count, nil
+}
+
+// Write delivers a packet on Outbound
+func (d *MemoryDevice) Write(packet []byte) (int, error) {
+	select {
+	case <-d.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+	select {
+	case d.outbound <- append([]byte(nil), packet...):
+	default:
+		// Dropped, the reader of Outbound doesn't keep up
+	}
+	return len(packet), nil
+}
+
+// WriteBatch delivers the packets on Outbound
+func (d *MemoryDevice) WriteBatch(packets [][]byte) (int, error) {
+	for i, packet := range packets {
+		if _, err := d.Write(packet); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
+
+// Close closes the device, Outbound isn't closed so that late writes don't panic
+func (d *MemoryDevice) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+	})
+	return nil
+}
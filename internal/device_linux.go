@@ -0,0 +1,244 @@
+//go:build linux
+
+package quicwire
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// tunCloneDevice is opened to create TUN interfaces
+const tunCloneDevice = "/dev/net/tun"
+
+// nativeTun is a TUN interface created directly through the Linux TUN driver.
+// Its file descriptor is non-blocking and served by the runtime poller, so a
+// batch read returns every packet already queued without waiting for more.
+//
+// When the kernel supports it, packets carry a virtio_net_hdr and the
+// interface offloads TCP segmentation and checksums: the kernel passes TCP
+// super-packets of up to 64KB in a single read, which are split into
+// segments of the MTU, and the segments of a batch written to the interface
+// are merged back, which saves most of the system calls of bulk transfers.
+type nativeTun struct {
+	file *os.File
+	raw  syscall.RawConn
+	name string
+	mtu  int
+	// vnetHdr is set when packets carry a virtio_net_hdr
+	vnetHdr bool
+	// readBuf holds the packet read with its virtio_net_hdr
+	readBuf []byte
+	// split holds the segments of the super-packet in readBuf that didn't fit
+	// in the buffers of the previous batch
+	split superPacket
+	// writeBuf holds the packet written with its virtio_net_hdr
+	writeBuf []byte
+}
+
+// newNativeTun creates a TUN interface carrying IP packets, with offloads
+// when the kernel supports them. An empty name lets the kernel pick one.
+func newNativeTun(name string, mtu int) (*nativeTun, error) {
+	t, err := openNativeTun(name, mtu, true)
+	if err == nil {
+		return t, nil
+	}
+	return openNativeTun(name, mtu, false)
+}
+
+// openNativeTun creates a TUN interface, whose packets carry a
+// virtio_net_hdr with the offloads enabled when vnetHdr is set
+func openNativeTun(name string, mtu int, vnetHdr bool) (*nativeTun, error) {
+	fd, err := unix.Open(tunCloneDevice, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", tunCloneDevice, err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	flags := uint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if vnetHdr {
+		flags |= unix.IFF_VNET_HDR
+	}
+	ifr.SetUint16(flags)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to create TUN interface: %w", err)
+	}
+	if vnetHdr {
+		// The header is little endian on every architecture
+		if err := unix.IoctlSetPointerInt(fd, unix.TUNSETVNETLE, 1); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to set the byte order of the TUN header: %w", err)
+		}
+		if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, tunOffloads); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to enable the offloads of the TUN interface: %w", err)
+		}
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), tunCloneDevice)
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	t := &nativeTun{file: file, raw: raw, name: ifr.Name(), mtu: mtu, vnetHdr: vnetHdr}
+	if vnetHdr {
+		t.readBuf = make([]byte, virtioNetHdrLen+maxSuperPacket)
+		t.writeBuf = make([]byte, virtioNetHdrLen+maxSuperPacket)
+	}
+	return t, nil
+}
+
+func (t *nativeTun) Name() string {
+	return t.name
+}
+
+func (t *nativeTun) MTU() int {
+	return t.mtu
+}
+
+func (t *nativeTun) Read(buf []byte) (int, error) {
+	if !t.vnetHdr {
+		return t.file.Read(buf)
+	}
+	sizes := []int{0}
+	if _, err := t.ReadBatch([][]byte{buf}, sizes); err != nil {
+		return 0, err
+	}
+	return sizes[0], nil
+}
+
+func (t *nativeTun) Write(packet []byte) (int, error) {
+	if !t.vnetHdr {
+		return t.file.Write(packet)
+	}
+	if _, err := t.WriteBatch([][]byte{packet}); err != nil {
+		return 0, err
+	}
+	return len(packet), nil
+}
+
+func (t *nativeTun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	// Segments left over by the previous batch come first
+	count := t.split.fill(bufs, sizes)
+	if count == len(bufs) {
+		return count, nil
+	}
+	var readErr error
+	err := t.raw.Read(func(fd uintptr) bool {
+		for count < len(bufs) {
+			buf := bufs[count]
+			if t.vnetHdr {
+				buf = t.readBuf
+			}
+			n, err := unix.Read(int(fd), buf)
+			switch {
+			case errors.Is(err, unix.EINTR):
+				continue
+			case errors.Is(err, unix.EAGAIN):
+				// Wait for the poller unless a packet was read already
+				return count > 0
+			case err != nil:
+				readErr = err
+				return true
+			}
+			if !t.vnetHdr {
+				sizes[count] = n
+				count++
+				continue
+			}
+			// Malformed packets are dropped
+			count += t.receive(t.readBuf[:n], bufs[count:], sizes[count:])
+		}
+		return true
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, readErr
+}
+
+// receive stores the packet read with its virtio_net_hdr in bufs, split into
+// segments when it is a super-packet, and returns the number of buffers used
+func (t *nativeTun) receive(packet []byte, bufs [][]byte, sizes []int) int {
+	if len(packet) <= virtioNetHdrLen {
+		return 0
+	}
+	var hdr virtioNetHdr
+	hdr.decode(packet)
+	packet = packet[virtioNetHdrLen:]
+	switch hdr.gsoType &^ unix.VIRTIO_NET_HDR_GSO_ECN {
+	case unix.VIRTIO_NET_HDR_GSO_NONE:
+		if hdr.flags&unix.VIRTIO_NET_HDR_F_NEEDS_CSUM != 0 {
+			if err := completeChecksum(packet, &hdr); err != nil {
+				return 0
+			}
+		}
+		if len(packet) > len(bufs[0]) {
+			return 0
+		}
+		sizes[0] = copy(bufs[0], packet)
+		return 1
+	case unix.VIRTIO_NET_HDR_GSO_TCPV4, unix.VIRTIO_NET_HDR_GSO_TCPV6:
+		if err := t.split.reset(packet, &hdr); err != nil {
+			return 0
+		}
+		return t.split.fill(bufs, sizes)
+	}
+	return 0
+}
+
+func (t *nativeTun) WriteBatch(packets [][]byte) (int, error) {
+	if !t.vnetHdr {
+		for i, packet := range packets {
+			if _, err := t.file.Write(packet); err != nil {
+				return i, err
+			}
+		}
+		return len(packets), nil
+	}
+	for i := 0; i < len(packets); {
+		n, merged := coalesce(t.writeBuf, packets[i:])
+		if err := t.write(t.writeBuf[:n]); err != nil {
+			return i, err
+		}
+		i += merged
+	}
+	return len(packets), nil
+}
+
+// write writes a packet with its virtio_net_hdr
+func (t *nativeTun) write(packet []byte) error {
+	var writeErr error
+	err := t.raw.Write(func(fd uintptr) bool {
+		for {
+			_, err := unix.Write(int(fd), packet)
+			switch {
+			case errors.Is(err, unix.EINTR):
+				continue
+			case errors.Is(err, unix.EAGAIN):
+				return false
+			}
+			writeErr = err
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+func (t *nativeTun) Close() error {
+	return t.file.Close()
+}
@@ -0,0 +1,45 @@
+//go:build !linux
+
+package quicwire
+
+import (
+	"github.com/songgao/water"
+)
+
+// waterDevice is a TUN interface created by the water package, which moves
+// one packet per read or write
+type waterDevice struct {
+	*water.Interface
+	mtu int
+}
+
+// newWaterDevice creates a TUN interface
+func newWaterDevice(mtu int) (*waterDevice, error) {
+	iface, err := water.New(water.Config{DeviceType: water.TUN})
+	if err != nil {
+		return nil, err
+	}
+	return &waterDevice{Interface: iface, mtu: mtu}, nil
+}
+
+func (d *waterDevice) MTU() int {
+	return d.mtu
+}
+
+func (d *waterDevice) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n, err := d.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+func (d *waterDevice) WriteBatch(packets [][]byte) (int, error) {
+	for i, packet := range packets {
+		if _, err := d.Write(packet); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
@@ -0,0 +1,25 @@
+package quicwire
+
+import "fmt"
+
+// LinkError records a failed operation while configuring the tunnel interface
+type LinkError struct {
+	// Op is the operation that failed, such as "set mtu" or "add route"
+	Op string
+	// Link is the name of the tunnel interface
+	Link string
+	// Arg is the address, route or value the operation was applied to, if any
+	Arg string
+	Err error
+}
+
+func (e *LinkError) Error() string {
+	if e.Arg == "" {
+		return fmt.Sprintf("%s on %s: %v", e.Op, e.Link, e.Err)
+	}
+	return fmt.Sprintf("%s %s on %s: %v", e.Op, e.Arg, e.Link, e.Err)
+}
+
+func (e *LinkError) Unwrap() error {
+	return e.Err
+}
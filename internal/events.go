@@ -0,0 +1,62 @@
+package quicwire
+
+import "time"
+
+// eventQueue is the number of events kept for a slow reader of Events
+const eventQueue = 256
+
+// EventType tells what an Event reports
+type EventType string
+
+const (
+	// EventPeerAdded reports a peer added at runtime or by a reload
+	EventPeerAdded EventType = "peer-added"
+	// EventPeerUpdated reports a peer whose configuration changed
+	EventPeerUpdated EventType = "peer-updated"
+	// EventPeerRemoved reports a removed peer
+	EventPeerRemoved EventType = "peer-removed"
+	// EventPeerState reports a change of the connection state of a peer
+	EventPeerState EventType = "peer-state"
+	// EventPeerRoamed reports a peer that connected from a new address
+	EventPeerRoamed EventType = "peer-roamed"
+	// EventPeerError reports a failure of a peer, the other peers keep working
+	EventPeerError EventType = "peer-error"
+	// EventNodeFailed reports an error that stopped the node
+	EventNodeFailed EventType = "node-failed"
+)
+
+// Event reports a change of the node or of one of its peers
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Peer is the identity of the peer, empty for events of the node
+	Peer string
+	// State is the new connection state of the peer, for EventPeerState
+	State string
+	// Endpoint is the new address of the peer, for EventPeerRoamed
+	Endpoint string
+	// Err is the failure of the peer for EventPeerError, or the error that
+	// stopped the node for EventNodeFailed
+	Err error
+}
+
+// Events returns the events of the node. The channel is never closed, and
+// events are dropped while it is full, so it should be read continuously.
+func (qn *QuicWire) Events() <-chan Event {
+	return qn.events
+}
+
+// reportPeerError records a failure of the peer and reports it
+func (qn *QuicWire) reportPeerError(p *peerState, err error) {
+	p.setError(err)
+	qn.emit(Event{Type: EventPeerError, Peer: p.identity(), Err: err})
+}
+
+// emit queues an event without waiting for the reader of Events
+func (qn *QuicWire) emit(event Event) {
+	event.Time = time.Now()
+	select {
+	case qn.events <- event:
+	default:
+	}
+}
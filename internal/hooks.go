@@ -0,0 +1,27 @@
+package quicwire
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// runHooks runs the commands of a PreUp, PostUp, PreDown or PostDown hook in
+// order with sh, stopping at the first one that fails. Like in wg-quick, %i is
+// replaced by the name of the tunnel interface.
+func (qn *QuicWire) runHooks(hook string, commands []string) error {
+	for _, command := range commands {
+		if qn.localIf != nil {
+			command = strings.ReplaceAll(command, "%i", qn.localIf.Name())
+		}
+		qn.logger.Infof("Running %s command: %s", hook, command)
+		out, err := exec.Command("sh", "-c", command).CombinedOutput()
+		if len(out) > 0 {
+			qn.logger.Infof("%s", strings.TrimSpace(string(out)))
+		}
+		if err != nil {
+			return fmt.Errorf("%s command %q failed: %w", hook, command, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package quicwire
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// routeTableAuto installs peer routes in the main routing table
+	routeTableAuto = 0
+	// routeTableOff disables the installation of peer routes
+	routeTableOff = -1
+)
+
+// parseRouteTable parses the Table option, which is auto, off or a table number
+func parseRouteTable(value string) (int, error) {
+	switch value {
+	case "auto":
+		return routeTableAuto, nil
+	case "off":
+		return routeTableOff, nil
+	}
+	table, err := strconv.Atoi(value)
+	if err != nil || table <= 0 {
+		return 0, fmt.Errorf("invalid Table %q, expected auto, off or a positive table number", value)
+	}
+	return table, nil
+}
+
+// installPeerRoutes routes the AllowedIPs of the peer through the tunnel
+// interface. A route that fails doesn't keep the others from being installed.
+func (qn *QuicWire) installPeerRoutes(peer Peer) error {
+	table := qn.qc.nodeInterface.table
+	if table == routeTableOff || qn.device != nil {
+		// A device given to UseDevice has no kernel interface to route to
+		return nil
+	}
+	qn.routesMu.Lock()
+	defer qn.routesMu.Unlock()
+	var errs []error
+	for _, prefix := range peer.allowedIPs {
+		if table == routeTableAuto && prefix.Bits() == 0 {
+			// A default route in the main table would also capture the QUIC
+			// traffic to the peers, it needs a dedicated table and policy rules
+			qn.logger.Warnf("Not installing default route %s of peer %s in the main table, use a numbered Table instead", prefix, peer.identity())
+			continue
+		}
+		if err := addRoute(qn.localIf.Name(), prefix, table); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		qn.kernelRoutes[prefix] = peer.identity()
+		qn.logger.Debugf("Installed route %s for peer %s", prefix, peer.identity())
+	}
+	return errors.Join(errs...)
+}
+
+// removePeerRoutes removes the routes installed for the AllowedIPs of the peer
+func (qn *QuicWire) removePeerRoutes(peer Peer) error {
+	qn.routesMu.Lock()
+	defer qn.routesMu.Unlock()
+	var errs []error
+	for prefix, owner := range qn.kernelRoutes {
+		if owner != peer.identity() {
+			continue
+		}
+		if err := delRoute(qn.localIf.Name(), prefix, qn.qc.nodeInterface.table); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(qn.kernelRoutes, prefix)
+	}
+	return errors.Join(errs...)
+}
+
+// removeAllRoutes removes every route installed by the node
+func (qn *QuicWire) removeAllRoutes() error {
+	qn.routesMu.Lock()
+	defer qn.routesMu.Unlock()
+	var errs []error
+	for prefix := range qn.kernelRoutes {
+		if err := delRoute(qn.localIf.Name(), prefix, qn.qc.nodeInterface.table); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(qn.kernelRoutes, prefix)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,77 @@
+package quicwire
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// KeyLen is the length in bytes of both private and public keys
+const KeyLen = 32
+
+// PrivateKey is the Ed25519 seed that identifies a node
+type PrivateKey [KeyLen]byte
+
+// PublicKey is the Ed25519 public key that identifies a peer
+type PublicKey [KeyLen]byte
+
+// GeneratePrivateKey creates a new random private key
+func GeneratePrivateKey() (PrivateKey, error) {
+	var k PrivateKey
+	if _, err := rand.Read(k[:]); err != nil {
+		return k, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	return k, nil
+}
+
+// ParsePrivateKey decodes a base64 encoded private key
+func ParsePrivateKey(s string) (PrivateKey, error) {
+	var k PrivateKey
+	if err := decodeKey(k[:], s); err != nil {
+		return k, fmt.Errorf("invalid private key: %w", err)
+	}
+	return k, nil
+}
+
+// ParsePublicKey decodes a base64 encoded public key
+func ParsePublicKey(s string) (PublicKey, error) {
+	var k PublicKey
+	if err := decodeKey(k[:], s); err != nil {
+		return k, fmt.Errorf("invalid public key: %w", err)
+	}
+	return k, nil
+}
+
+func decodeKey(dst []byte, s string) error {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != KeyLen {
+		return fmt.Errorf("key must be %d bytes, got %d", KeyLen, len(b))
+	}
+	copy(dst, b)
+	return nil
+}
+
+// PublicKey derives the public key for the private key
+func (k PrivateKey) PublicKey() PublicKey {
+	var pub PublicKey
+	copy(pub[:], k.signer().Public().(ed25519.PublicKey))
+	return pub
+}
+
+// String returns the base64 encoding of the private key
+func (k PrivateKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// String returns the base64 encoding of the public key
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+func (k PrivateKey) signer() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(k[:])
+}
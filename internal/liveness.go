@@ -0,0 +1,291 @@
+package quicwire
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// peerConnState is the state of the connection to a peer
+type peerConnState int32
+
+const (
+	// peerIdle waits for the peer to connect, because the node can't dial it
+	peerIdle peerConnState = iota
+	// peerConnecting dials the peer
+	peerConnecting
+	// peerEstablished has a working connection to the peer
+	peerEstablished
+	// peerBackoff waits before dialing the peer again
+	peerBackoff
+	// peerFailed gave up dialing the peer for a while
+	peerFailed
+)
+
+func (s peerConnState) String() string {
+	switch s {
+	case peerIdle:
+		return "idle"
+	case peerConnecting:
+		return "connecting"
+	case peerEstablished:
+		return "established"
+	case peerBackoff:
+		return "backoff"
+	case peerFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// connState returns the state of the connection to the peer
+func (p *peerState) connState() peerConnState {
+	return peerConnState(p.state.Load())
+}
+
+// setConnState moves the peer to a new state and logs the transition
+func (qn *QuicWire) setConnState(p *peerState, state peerConnState) {
+	old := peerConnState(p.state.Swap(int32(state)))
+	if old != state {
+		qn.logger.Infof("Peer %s is %s (was %s)", p.identity(), state, old)
+		qn.emit(Event{Type: EventPeerState, Peer: p.identity(), State: state.String()})
+	}
+}
+
+// setClient makes c the connection used to reach the peer, and wakes up the
+// supervisor of the peer to watch the new connection. The connection it
+// replaces is closed. When both nodes dial each other at the same time only
+// the preferred connection is kept: c is closed and false is returned if it
+// loses against a recent connection to the peer.
+func (qn *QuicWire) setClient(p *peerState, c *Client) bool {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+	if p.ctx.Err() != nil {
+		// the peer was removed
+		_ = c.connection.CloseWithError(errCodeUnknownPeer, "unknown peer")
+		return false
+	}
+	old := p.client.Load()
+	if old != nil && old.connection.Context().Err() == nil &&
+		time.Since(old.since) < simultaneousDialWindow && qn.preferred(old) && !qn.preferred(c) {
+		qn.logger.Debugf("Closing duplicate connection to peer %s from %v", p.identity(), c.connection.RemoteAddr())
+		_ = c.connection.CloseWithError(errCodeDuplicate, "duplicate connection")
+		return false
+	}
+	p.client.Store(c)
+	p.wake()
+	qn.learnEndpoint(p, c.connection.RemoteAddr().String())
+	if old != nil {
+		qn.logger.Debugf("Closing replaced connection to peer %s from %v", p.identity(), old.connection.RemoteAddr())
+		_ = old.connection.CloseWithError(errCodeDuplicate, "duplicate connection")
+	}
+	return true
+}
+
+// preferred reports whether c is the connection kept when the nodes dial each
+// other: the one dialed by the node with the lower public key. Both nodes
+// compare the same two keys, so they agree on the connection to close.
+func (qn *QuicWire) preferred(c *Client) bool {
+	localLower := bytes.Compare(qn.localKeyInfo, c.remoteKeyInfo()) < 0
+	return c.dialed == localLower
+}
+
+// learnEndpoint records the address the peer is connected from. A peer that
+// dialed the connection keeps it when its address changes, QUIC migrates the
+// connection to the new address once the path is validated. A peer that
+// accepted the connection can't migrate it, it opens a new one from its new
+// address instead. Either way the new address is used to dial the peer again.
+func (qn *QuicWire) learnEndpoint(p *peerState, endpoint string) {
+	old := p.learnedEndpoint.Swap(&endpoint)
+	if old != nil && *old != endpoint {
+		qn.logger.Infof("Peer %s roamed from %s to %s", p.identity(), *old, endpoint)
+		qn.emit(Event{Type: EventPeerRoamed, Peer: p.identity(), Endpoint: endpoint})
+	}
+}
+
+// endpoints returns the addresses to dial the peer at: the learned endpoint
+// first, then the configured one
+func (p *peerState) endpoints() []string {
+	var endpoints []string
+	if learned := p.learnedEndpoint.Load(); learned != nil {
+		endpoints = append(endpoints, *learned)
+	}
+	if endpoint := p.config().endpoint; endpoint != "" && (len(endpoints) == 0 || !sameEndpoint(endpoints[0], endpoint)) {
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// sameEndpoint reports whether the configured endpoint resolves to the learned address
+func sameEndpoint(learned string, configured string) bool {
+	if learned == configured {
+		return true
+	}
+	addr, err := net.ResolveUDPAddr("udp", configured)
+	return err == nil && addr.String() == learned
+}
+
+// canDial reports whether the node initiates connections to the peer
+func (qn *QuicWire) canDial(p *peerState) bool {
+	return !qn.disableClient && (p.config().endpoint != "" || p.learnedEndpoint.Load() != nil)
+}
+
+// supervise keeps a connection to the peer until the node stops or the peer
+// is removed. It waits on the current connection and re-dials the peer when it
+// is lost, or waits for the peer to connect when it can't be dialed.
+func (qn *QuicWire) supervise(p *peerState) {
+	// flapDelay grows while connections are lost right after they are
+	// established, for instance when the peer rejects our certificate after
+	// the handshake completed on our side
+	var flapDelay time.Duration
+	for {
+		c := p.client.Load()
+		if c == nil {
+			if flapDelay > 0 && qn.canDial(p) {
+				qn.setConnState(p, peerBackoff)
+				select {
+				case <-time.After(flapDelay):
+				case <-p.changed:
+				case <-p.ctx.Done():
+					return
+				}
+				if p.client.Load() != nil {
+					continue
+				}
+			}
+			if qn.canDial(p) {
+				qn.dial(p)
+			} else {
+				qn.setConnState(p, peerIdle)
+				select {
+				case <-p.changed:
+				case <-p.ctx.Done():
+				}
+			}
+			if p.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		qn.setConnState(p, peerEstablished)
+		if !qn.watch(p, c) {
+			return
+		}
+		if p.client.Load() == nil && time.Since(c.since) < retryInterval {
+			flapDelay *= 2
+			if flapDelay < retryInterval {
+				flapDelay = retryInterval
+			} else if flapDelay > maxRetryInterval {
+				flapDelay = maxRetryInterval
+			}
+			qn.logger.Warnf("Connection to peer %s was lost right after it was established, dialing again in %s", p.identity(), flapDelay)
+		} else {
+			flapDelay = 0
+		}
+	}
+}
+
+// watch waits until the connection c to the peer is lost or replaced, and
+// returns false once the node stops or the peer is removed. QUIC only sends
+// the PersistentKeepalive of the peer on connections this node dialed, so it
+// is sent from here on connections accepted from the peer. The peer of an
+// accepted connection can migrate it to another address, which is then learned.
+func (qn *QuicWire) watch(p *peerState, c *Client) bool {
+	var keepalive, migration <-chan time.Time
+	if keepAlive := p.config().persistentKeepalive; !c.dialed && keepAlive > 0 {
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	if !c.dialed {
+		ticker := time.NewTicker(migrationCheckInterval)
+		defer ticker.Stop()
+		migration = ticker.C
+	}
+	for {
+		select {
+		case <-c.connection.Context().Done():
+			if p.client.CompareAndSwap(c, nil) {
+				qn.logger.Warnf("Lost connection to peer %s", p.identity())
+			}
+			return true
+		case <-p.changed:
+			// the connection was replaced by a new one
+			return true
+		case <-keepalive:
+			if err := c.SendKeepalive(); err != nil {
+				qn.logger.Debugf("Failed to send keepalive to peer %s: %v", p.identity(), err)
+			}
+		case <-migration:
+			qn.learnEndpoint(p, c.connection.RemoteAddr().String())
+		case <-p.ctx.Done():
+			return false
+		}
+	}
+}
+
+// dial connects to the peer, retrying with an exponential backoff and
+// alternating between its learned and configured endpoints. When every retry
+// fails the peer is marked failed and dialed again after a pause.
+func (qn *QuicWire) dial(p *peerState) {
+	endpoints := p.endpoints()
+
+	// Stop dialing as soon as the peer connects to us
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.changed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	attempt := 0
+	err := RetryOperation(ctx, retryInterval, maxRetryInterval, retries, func() error {
+		if p.client.Load() != nil {
+			qn.logger.Infof("Connection already exists for peer %s", p.identity())
+			return nil
+		}
+		endpoint := endpoints[attempt%len(endpoints)]
+		attempt++
+		qn.setConnState(p, peerConnecting)
+		qn.logger.Debugf("No existing connection to the peer endpoint %s.", endpoint)
+
+		c, err := NewClient(endpoint, p.identity(), qn.qc.nodeInterface.localNodeIP, qn.qc.nodeInterface.listenPort, p.tlsConf, qn.quicConfig(p.config().persistentKeepalive), qn.logger)
+		if err != nil {
+			return err
+		}
+		err = c.Dial(ctx, qn.transport)
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			qn.logger.Debugf("Failed to dial: %v", err)
+			qn.logger.Warnf("Retrying to dial %s", endpoint)
+			p.setError(err)
+			qn.setConnState(p, peerBackoff)
+			return err
+		}
+		qn.logger.Infof("Dialed new connection to peer endpoint %s.", endpoint)
+		if qn.setClient(p, c) {
+			qn.receive(c.connection, p, qn.handlePacket)
+		}
+		return nil
+	})
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+
+	qn.logger.Errorf("Peer %s is not reachable, retrying in %s: %v", p.identity(), failedRetryInterval, err)
+	qn.reportPeerError(p, fmt.Errorf("not reachable: %w", err))
+	qn.setConnState(p, peerFailed)
+	select {
+	case <-time.After(failedRetryInterval):
+	case <-p.changed:
+	case <-p.ctx.Done():
+	}
+}
@@ -0,0 +1,299 @@
+package quicwire
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	// netstackNIC is the only interface of the userspace stack
+	netstackNIC tcpip.NICID = 1
+	// netstackQueue is the number of packets the stack queues for the node
+	netstackQueue = 1024
+)
+
+// Netstack is a Device that terminates the tunnel in a TCP/IP stack running
+// in the process, so the node needs neither root nor a TUN interface. The
+// mesh is reached with DialContext, Listen and ListenPacket instead of the
+// sockets of the host.
+type Netstack struct {
+	stack        *stack.Stack
+	ep           *channel.Endpoint
+	mtu          int
+	hasV4, hasV6 bool
+
+	// ctx ends the reads of the node when the stack is closed
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// NewNetstack creates a userspace TCP/IP stack with the given interface addresses
+func NewNetstack(addresses []netip.Prefix, mtu int) (*Netstack, error) {
+	ns := &Netstack{
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+			HandleLocal:        true,
+		}),
+		ep:  channel.New(netstackQueue, uint32(mtu), ""),
+		mtu: mtu,
+	}
+	ns.ctx, ns.cancel = context.WithCancel(context.Background())
+	// SACK is off by default and speeds up recovery from lost packets
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := ns.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("failed to enable TCP SACK: %v", err)
+	}
+	if err := ns.stack.CreateNIC(netstackNIC, ns.ep); err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("failed to create netstack interface: %v", err)
+	}
+	for _, prefix := range addresses {
+		protoAddr := tcpip.ProtocolAddress{
+			Protocol: networkProtocol(prefix.Addr()),
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   tcpip.AddrFromSlice(prefix.Addr().AsSlice()),
+				PrefixLen: prefix.Bits(),
+			},
+		}
+		if err := ns.stack.AddProtocolAddress(netstackNIC, protoAddr, stack.AddressProperties{}); err != nil {
+			ns.Close()
+			return nil, fmt.Errorf("failed to add address %s to netstack: %v", prefix, err)
+		}
+		if prefix.Addr().Is4() {
+			ns.hasV4 = true
+		} else {
+			ns.hasV6 = true
+		}
+	}
+	// Every destination goes to the node, which drops those outside of the AllowedIPs
+	if ns.hasV4 {
+		ns.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: netstackNIC})
+	}
+	if ns.hasV6 {
+		ns.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: netstackNIC})
+	}
+	return ns, nil
+}
+
+func networkProtocol(addr netip.Addr) tcpip.NetworkProtocolNumber {
+	if addr.Is4() || addr.Is4In6() {
+		return ipv4.ProtocolNumber
+	}
+	return ipv6.ProtocolNumber
+}
+
+// Name returns the name of the device
+func (ns *Netstack) Name() string {
+	return "netstack"
+}
+
+// MTU returns the MTU of the stack
+func (ns *Netstack) MTU() int {
+	return ns.mtu
+}
+
+// Read returns a packet sent by the stack, waiting for one
+func (ns *Netstack) Read(buf []byte) (int, error) {
+	pkt := ns.ep.ReadContext(ns.ctx)
+	if pkt == nil {
+		return 0, os.ErrClosed
+	}
+	return copyPacket(buf, pkt), nil
+}
+
+// ReadBatch returns the packets sent by the stack, waiting for the first one
+func (ns *Netstack) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n, err := ns.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	count := 1
+	for count < len(bufs) {
+		pkt := ns.ep.Read()
+		if pkt == nil {
+			break
+		}
+		sizes[count] = copyPacket(bufs[count], pkt)
+		count++
+	}
+	return count, nil
+}
+
+// copyPacket copies the packet to buf and releases it
+func copyPacket(buf []byte, pkt *stack.PacketBuffer) int {
+	view := pkt.ToView()
+	n := copy(buf, view.AsSlice())
+	view.Release()
+	pkt.DecRef()
+	return n
+}
+
+// Write passes a packet received from a peer to the stack
+func (ns *Netstack) Write(packet []byte) (int, error) {
+	if ns.ctx.Err() != nil {
+		return 0, os.ErrClosed
+	}
+	if len(packet) == 0 {
+		return 0, nil
+	}
+	var proto tcpip.NetworkProtocolNumber
+	switch packet[0] >> 4 {
+	case 4:
+		proto = header.IPv4ProtocolNumber
+	case 6:
+		proto = header.IPv6ProtocolNumber
+	default:
+		return 0, syscall.EAFNOSUPPORT
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+	ns.ep.InjectInbound(proto, pkt)
+	pkt.DecRef()
+	return len(packet), nil
+}
+
+// WriteBatch passes the packets received from peers to the stack
+func (ns *Netstack) WriteBatch(packets [][]byte) (int, error) {
+	for i, packet := range packets {
+		if _, err := ns.Write(packet); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
+
+// Close shuts the stack down, which closes its connections and listeners
+func (ns *Netstack) Close() error {
+	ns.closeOnce.Do(func() {
+		ns.cancel()
+		ns.stack.Close()
+		ns.ep.Close()
+	})
+	return nil
+}
+
+// fullAddress resolves the address of a TCP or UDP endpoint in the stack. An
+// empty host is the unspecified address of the given network.
+func (ns *Netstack) fullAddress(ctx context.Context, network, address string) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	if host == "" {
+		proto := ipv6.ProtocolNumber
+		if network == "tcp4" || network == "udp4" || !ns.hasV6 {
+			proto = ipv4.ProtocolNumber
+		}
+		return tcpip.FullAddress{NIC: netstackNIC, Port: uint16(port)}, proto, nil
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		// Names are resolved by the resolver of the host, so their DNS
+		// queries don't go through the tunnel
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, ipNetwork(network), host)
+		if err != nil {
+			return tcpip.FullAddress{}, 0, err
+		}
+		addr = addrs[0]
+	}
+	addr = addr.Unmap()
+	return tcpip.FullAddress{NIC: netstackNIC, Addr: tcpip.AddrFromSlice(addr.AsSlice()), Port: uint16(port)}, networkProtocol(addr), nil
+}
+
+// ipNetwork returns the IP network to resolve names of a TCP or UDP network
+func ipNetwork(network string) string {
+	switch network {
+	case "tcp4", "udp4":
+		return "ip4"
+	case "tcp6", "udp6":
+		return "ip6"
+	}
+	return "ip"
+}
+
+// DialContext connects to the address on the named network through the
+// tunnel. The network is tcp or udp, optionally followed by 4 or 6. Host
+// names are resolved with net.DefaultResolver, outside of the tunnel.
+func (ns *Netstack) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addr, proto, err := ns.fullAddress(ctx, network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	// The gonet constructors return typed nil pointers on errors
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		conn, err := gonet.DialContextTCP(ctx, ns.stack, addr, proto)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	case "udp", "udp4", "udp6":
+		conn, err := gonet.DialUDP(ns.stack, nil, &addr, proto)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+}
+
+// Listen listens for TCP connections from the mesh on address
+func (ns *Netstack) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	addr, proto, err := ns.fullAddress(context.Background(), network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	listener, err := gonet.ListenTCP(ns.stack, addr, proto)
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ListenPacket listens for UDP packets from the mesh on address
+func (ns *Netstack) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	addr, proto, err := ns.fullAddress(context.Background(), network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	conn, err := gonet.DialUDP(ns.stack, &addr, nil, proto)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,119 @@
+package quicwire
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startNetstackPair starts a pair of connected nodes like startPair, both
+// terminating the tunnel in the userspace TCP/IP stack
+func startNetstackPair(t *testing.T) (*testNode, *testNode) {
+	a, b := newTestNode(t, 1), newTestNode(t, 2)
+	a.netstack, b.netstack = true, true
+	return startNodes(t, a, b)
+}
+
+// echoTCP serves connections of listener by writing back what they read
+func echoTCP(t *testing.T, listener net.Listener) {
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+// expectEcho writes data to conn and checks that it is read back
+func expectEcho(t *testing.T, conn net.Conn, data []byte) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %q back, want %q", got, data)
+	}
+}
+
+func TestNetstackTCP(t *testing.T) {
+	a, b := startNetstackPair(t)
+	listener, err := b.qw.Netstack().Listen("tcp", ":8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTCP(t, listener)
+
+	tests := []struct {
+		name    string
+		network string
+		host    string
+	}{
+		{"ipv4", "tcp4", b.v4.String()},
+		{"ipv6", "tcp6", b.v6.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := a.qw.Netstack().DialContext(t.Context(), tt.network, net.JoinHostPort(tt.host, "8000"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			expectEcho(t, conn, []byte("hello "+tt.name))
+			// Larger than the MTU, so carried in several segments
+			expectEcho(t, conn, bytes.Repeat([]byte{0x42}, 64*1024))
+		})
+	}
+}
+
+func TestNetstackUDP(t *testing.T) {
+	a, b := startNetstackPair(t)
+	server, err := b.qw.Netstack().ListenPacket("udp", ":9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := a.qw.Netstack().DialContext(t.Context(), "udp", net.JoinHostPort(b.v4.String(), "9000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn, []byte("hello"))
+}
+
+func TestNetstackUnknownNetwork(t *testing.T) {
+	a, _ := startNetstackPair(t)
+	if _, err := a.qw.Netstack().DialContext(t.Context(), "ip", "10.99.0.2:1"); err == nil {
+		t.Errorf("dialing ip succeeded")
+	}
+	if _, err := a.qw.Netstack().Listen("udp", ":1"); err == nil {
+		t.Errorf("listening for TCP connections on udp succeeded")
+	}
+	if _, err := a.qw.Netstack().ListenPacket("tcp", ":1"); err == nil {
+		t.Errorf("listening for UDP packets on tcp succeeded")
+	}
+}
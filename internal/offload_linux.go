@@ -0,0 +1,359 @@
+//go:build linux
+
+package quicwire
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// virtioNetHdrLen is the size of the virtio_net_hdr in front of the
+	// packets of a TUN interface created with IFF_VNET_HDR
+	virtioNetHdrLen = 10
+	// tunOffloads are the offloads of the TUN interface: the kernel passes
+	// TCP super-packets of up to 64KB without checksum, which the node splits
+	// into segments, and accepts the segments the node merges back
+	tunOffloads = unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6
+	// maxSuperPacket is the largest IP packet carried with a virtio_net_hdr
+	maxSuperPacket = 65535
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+	// tcpChecksumOffset is the offset of the checksum in the TCP header
+	tcpChecksumOffset = 16
+)
+
+var errBadOffload = errors.New("malformed packet from the TUN interface")
+
+// virtioNetHdr is the struct virtio_net_hdr of the Linux kernel, stored in
+// little endian as set up with TUNSETVNETLE
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	h.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	h.csumStart = binary.LittleEndian.Uint16(b[6:])
+	h.csumOffset = binary.LittleEndian.Uint16(b[8:])
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// checksumNoFold adds the 16 bit words of b to the unfolded ones' complement sum initial
+func checksumNoFold(b []byte, initial uint64) uint64 {
+	sum := initial
+	for len(b) >= 8 {
+		sum += uint64(binary.BigEndian.Uint32(b)) + uint64(binary.BigEndian.Uint32(b[4:]))
+		b = b[8:]
+	}
+	if len(b) >= 4 {
+		sum += uint64(binary.BigEndian.Uint32(b))
+		b = b[4:]
+	}
+	if len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds an unfolded ones' complement sum to 16 bits
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum returns the unfolded sum of the pseudo header of a TCP or
+// UDP packet with the given addresses
+func pseudoHeaderSum(proto uint8, src, dst []byte, length int) uint64 {
+	sum := checksumNoFold(src, 0)
+	sum = checksumNoFold(dst, sum)
+	return sum + uint64(proto) + uint64(length)
+}
+
+// ipAddresses returns the source and destination addresses of an IP packet
+func ipAddresses(packet []byte) (src, dst []byte) {
+	if packet[0]>>4 == 4 {
+		return packet[12:16], packet[16:20]
+	}
+	return packet[8:24], packet[24:40]
+}
+
+// setIPLength stores the length of an IP packet in its header, and updates
+// the header checksum of IPv4
+func setIPLength(packet []byte, length int) {
+	if packet[0]>>4 == 4 {
+		ihl := int(packet[0]&0x0f) * 4
+		binary.BigEndian.PutUint16(packet[2:], uint16(length))
+		packet[10], packet[11] = 0, 0
+		binary.BigEndian.PutUint16(packet[10:], ^checksumFold(checksumNoFold(packet[:ihl], 0)))
+		return
+	}
+	binary.BigEndian.PutUint16(packet[4:], uint16(length-40))
+}
+
+// completeChecksum computes the checksum the kernel left to the device. The
+// checksum field at csumStart+csumOffset holds the sum of the pseudo header.
+func completeChecksum(packet []byte, hdr *virtioNetHdr) error {
+	start, offset := int(hdr.csumStart), int(hdr.csumStart)+int(hdr.csumOffset)
+	if start >= len(packet) || offset+2 > len(packet) {
+		return errBadOffload
+	}
+	binary.BigEndian.PutUint16(packet[offset:], ^checksumFold(checksumNoFold(packet[start:], 0)))
+	return nil
+}
+
+// superPacket is a TCP packet read from the TUN interface with a payload of
+// more than one segment, which is split into packets of the MTU
+type superPacket struct {
+	packet []byte
+	// ipLen and hdrLen are the length of the IP header and of the IP and TCP headers
+	ipLen, hdrLen int
+	gsoSize       int
+	// next is the segment returned next, count the number of segments
+	next, count int
+}
+
+// reset prepares the split of packet as described by hdr
+func (s *superPacket) reset(packet []byte, hdr *virtioNetHdr) error {
+	*s = superPacket{}
+	if len(packet) == 0 || hdr.gsoSize == 0 {
+		return errBadOffload
+	}
+	isV4 := packet[0]>>4 == 4
+	if isV4 != (hdr.gsoType&^unix.VIRTIO_NET_HDR_GSO_ECN == unix.VIRTIO_NET_HDR_GSO_TCPV4) {
+		return errBadOffload
+	}
+	// The TCP header starts at csumStart, past the IPv6 extension headers
+	ipLen := int(hdr.csumStart)
+	if hdr.flags&unix.VIRTIO_NET_HDR_F_NEEDS_CSUM == 0 {
+		ipLen = 40
+		if isV4 {
+			ipLen = int(packet[0]&0x0f) * 4
+		}
+	}
+	if ipLen < 20 || ipLen+20 > len(packet) {
+		return errBadOffload
+	}
+	hdrLen := ipLen + int(packet[ipLen+12]>>4)*4
+	if hdrLen > len(packet) {
+		return errBadOffload
+	}
+	gsoSize := int(hdr.gsoSize)
+	s.packet = packet
+	s.ipLen, s.hdrLen, s.gsoSize = ipLen, hdrLen, gsoSize
+	s.count = (len(packet) - hdrLen + gsoSize - 1) / gsoSize
+	return nil
+}
+
+// pending reports whether segments are left to return
+func (s *superPacket) pending() bool {
+	return s.next < s.count
+}
+
+// fill stores the next segments in bufs and their sizes in sizes, and
+// returns the number stored. Segments larger than their buffer are dropped.
+func (s *superPacket) fill(bufs [][]byte, sizes []int) int {
+	n := 0
+	for n < len(bufs) && s.next < s.count {
+		if size := s.segment(s.next, bufs[n]); size > 0 {
+			sizes[n] = size
+			n++
+		}
+		s.next++
+	}
+	return n
+}
+
+// segment builds segment i in dst and returns its size, or 0 if it doesn't fit
+func (s *superPacket) segment(i int, dst []byte) int {
+	start := s.hdrLen + i*s.gsoSize
+	end := start + s.gsoSize
+	if end > len(s.packet) {
+		end = len(s.packet)
+	}
+	size := s.hdrLen + end - start
+	if size > len(dst) {
+		return 0
+	}
+	copy(dst, s.packet[:s.hdrLen])
+	copy(dst[s.hdrLen:], s.packet[start:end])
+	seg := dst[:size]
+
+	if seg[0]>>4 == 4 {
+		id := binary.BigEndian.Uint16(seg[4:])
+		binary.BigEndian.PutUint16(seg[4:], id+uint16(i))
+	}
+	setIPLength(seg, size)
+
+	tcp := seg[s.ipLen:]
+	seq := binary.BigEndian.Uint32(tcp[4:])
+	binary.BigEndian.PutUint32(tcp[4:], seq+uint32(i*s.gsoSize))
+	if i != s.count-1 {
+		tcp[13] &^= tcpFlagFIN | tcpFlagPSH
+	}
+	if i != 0 {
+		tcp[13] &^= tcpFlagCWR
+	}
+	tcp[tcpChecksumOffset], tcp[tcpChecksumOffset+1] = 0, 0
+	src, dstAddr := ipAddresses(seg)
+	sum := pseudoHeaderSum(unix.IPPROTO_TCP, src, dstAddr, len(tcp))
+	binary.BigEndian.PutUint16(tcp[tcpChecksumOffset:], ^checksumFold(checksumNoFold(tcp, sum)))
+	return size
+}
+
+// tcpSegment locates the headers of a TCP packet that can be merged with
+// the segments of the same flow. IPv4 options, fragments and IPv6 extension
+// headers are never merged, nor are segments with flags other than ACK and PSH.
+func tcpSegment(packet []byte) (ipLen, hdrLen int, ok bool) {
+	if len(packet) == 0 {
+		return 0, 0, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 40 || packet[0]&0x0f != 5 || packet[9] != unix.IPPROTO_TCP ||
+			binary.BigEndian.Uint16(packet[6:])&0x3fff != 0 ||
+			int(binary.BigEndian.Uint16(packet[2:])) != len(packet) {
+			return 0, 0, false
+		}
+		ipLen = 20
+	case 6:
+		if len(packet) < 60 || packet[6] != unix.IPPROTO_TCP ||
+			int(binary.BigEndian.Uint16(packet[4:]))+40 != len(packet) {
+			return 0, 0, false
+		}
+		ipLen = 40
+	default:
+		return 0, 0, false
+	}
+	hdrLen = ipLen + int(packet[ipLen+12]>>4)*4
+	flags := packet[ipLen+13]
+	if hdrLen < ipLen+20 || hdrLen >= len(packet) || flags&^tcpFlagPSH != tcpFlagACK {
+		return 0, 0, false
+	}
+	return ipLen, hdrLen, true
+}
+
+// sameFlow reports whether the segment b follows a in the same TCP flow with
+// the same headers, apart from the lengths, the IPv4 ID and checksums
+func sameFlow(a, b []byte, ipLen, hdrLen int) bool {
+	if ipLen == 20 {
+		// Type of service, flags, TTL, protocol and addresses
+		if a[1] != b[1] || a[6] != b[6] || a[8] != b[8] || string(a[12:20]) != string(b[12:20]) {
+			return false
+		}
+	} else if string(a[:4]) != string(b[:4]) || string(a[6:40]) != string(b[6:40]) {
+		// Traffic class, flow label, next header, hop limit and addresses
+		return false
+	}
+	ta, tb := a[ipLen:hdrLen], b[ipLen:hdrLen]
+	// Ports, acknowledgment, header length, window and options. The flags of
+	// a are ACK, those of b ACK or ACK and PSH.
+	return string(ta[:4]) == string(tb[:4]) && string(ta[8:13]) == string(tb[8:13]) &&
+		string(ta[14:16]) == string(tb[14:16]) && string(ta[20:]) == string(tb[20:])
+}
+
+// checksumsValid reports whether the TCP checksum of a segment, and the
+// header checksum of IPv4, are correct. The kernel trusts the checksums of a
+// merged super-packet, which are computed again, so the segments with a
+// corrupted checksum must not be merged.
+func checksumsValid(packet []byte, ipLen int) bool {
+	if ipLen == 20 && checksumFold(checksumNoFold(packet[:20], 0)) != 0xffff {
+		return false
+	}
+	src, dst := ipAddresses(packet)
+	tcp := packet[ipLen:]
+	return checksumFold(checksumNoFold(tcp, pseudoHeaderSum(unix.IPPROTO_TCP, src, dst, len(tcp)))) == 0xffff
+}
+
+// coalesce merges the first packets of the batch that are consecutive
+// segments of a TCP flow into a super-packet written to buf behind a
+// virtio_net_hdr, like the GRO of a NIC. It returns the length written to
+// buf and the number of packets merged, a packet that can't be merged is
+// written alone. Like the GRO of wireguard-go, segments are only merged once
+// their checksums are checked.
+func coalesce(buf []byte, packets [][]byte) (int, int) {
+	first := packets[0]
+	var hdr virtioNetHdr
+	ipLen, hdrLen, ok := tcpSegment(first)
+	if !ok || first[ipLen+13]&tcpFlagPSH != 0 || len(packets) == 1 || !checksumsValid(first, ipLen) {
+		hdr.encode(buf)
+		return virtioNetHdrLen + copy(buf[virtioNetHdrLen:], first), 1
+	}
+
+	gsoSize := len(first) - hdrLen
+	size := len(first)
+	nextSeq := binary.BigEndian.Uint32(first[ipLen+4:]) + uint32(gsoSize)
+	count := 1
+	for _, p := range packets[1:] {
+		pIPLen, pHdrLen, ok := tcpSegment(p)
+		payload := len(p) - pHdrLen
+		if !ok || pIPLen != ipLen || pHdrLen != hdrLen || payload > gsoSize ||
+			size+payload > maxSuperPacket || binary.BigEndian.Uint32(p[ipLen+4:]) != nextSeq ||
+			!sameFlow(first, p, ipLen, hdrLen) || !checksumsValid(p, ipLen) {
+			break
+		}
+		size += payload
+		nextSeq += uint32(payload)
+		count++
+		// A short or pushed segment ends the super-packet
+		if payload < gsoSize || p[ipLen+13]&tcpFlagPSH != 0 {
+			break
+		}
+	}
+	if count == 1 {
+		hdr.encode(buf)
+		return virtioNetHdrLen + copy(buf[virtioNetHdrLen:], first), 1
+	}
+
+	out := buf[virtioNetHdrLen:]
+	n := copy(out, first)
+	last := packets[count-1]
+	for _, p := range packets[1:count] {
+		n += copy(out[n:], p[hdrLen:])
+	}
+	super := out[:n]
+	super[ipLen+13] |= last[ipLen+13] & tcpFlagPSH
+	setIPLength(super, n)
+	src, dst := ipAddresses(super)
+	binary.BigEndian.PutUint16(super[ipLen+tcpChecksumOffset:], checksumFold(pseudoHeaderSum(unix.IPPROTO_TCP, src, dst, n-ipLen)))
+
+	hdr = virtioNetHdr{
+		flags:      unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		gsoType:    unix.VIRTIO_NET_HDR_GSO_TCPV6,
+		hdrLen:     uint16(hdrLen),
+		gsoSize:    uint16(gsoSize),
+		csumStart:  uint16(ipLen),
+		csumOffset: tcpChecksumOffset,
+	}
+	if ipLen == 20 {
+		hdr.gsoType = unix.VIRTIO_NET_HDR_GSO_TCPV4
+	}
+	hdr.encode(buf)
+	return virtioNetHdrLen + n, count
+}
@@ -0,0 +1,581 @@
+//go:build linux
+
+package quicwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpOptions are the options of the test segments, a timestamp padded with NOPs
+var tcpOptions = []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2}
+
+// refChecksum is the ones' complement checksum of RFC 1071 computed one
+// 16 bit word at a time, the reference for the checksums of the offloads
+func refChecksum(chunks ...[]byte) uint16 {
+	var data []byte
+	for _, c := range chunks {
+		data = append(data, c...)
+	}
+	if len(data)%2 == 1 {
+		data = append(data, 0)
+	}
+	var sum uint32
+	for i := 0; i < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// refPseudoHeader returns the TCP pseudo header of packet for a TCP length of length
+func refPseudoHeader(packet []byte, length int) []byte {
+	src, dst := ipAddresses(packet)
+	ph := append(append([]byte(nil), src...), dst...)
+	if len(src) == 4 {
+		return append(ph, 0, unix.IPPROTO_TCP, byte(length>>8), byte(length))
+	}
+	return append(ph, 0, 0, byte(length>>8), byte(length), 0, 0, 0, unix.IPPROTO_TCP)
+}
+
+// tcpSpec describes a TCP packet built by tcpPacket
+type tcpSpec struct {
+	ipv6    bool
+	id      uint16
+	seq     uint32
+	flags   byte
+	payload []byte
+}
+
+// tcpPacket builds a TCP packet with the test options and valid checksums
+func tcpPacket(s tcpSpec) []byte {
+	ipLen := 20
+	if s.ipv6 {
+		ipLen = 40
+	}
+	tcpLen := 20 + len(tcpOptions) + len(s.payload)
+	p := make([]byte, ipLen+tcpLen)
+	if s.ipv6 {
+		p[0] = 0x60
+		binary.BigEndian.PutUint16(p[4:], uint16(tcpLen))
+		p[6] = unix.IPPROTO_TCP
+		p[7] = 64
+		copy(p[8:24], []byte{0xfd, 0x99, 15: 1})
+		copy(p[24:40], []byte{0xfd, 0x99, 15: 2})
+	} else {
+		p[0] = 0x45
+		binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+		binary.BigEndian.PutUint16(p[4:], s.id)
+		p[6] = 0x40 // Don't fragment
+		p[8] = 64
+		p[9] = unix.IPPROTO_TCP
+		copy(p[12:16], []byte{10, 99, 0, 1})
+		copy(p[16:20], []byte{10, 99, 0, 2})
+		binary.BigEndian.PutUint16(p[10:], refChecksum(p[:20]))
+	}
+	tcp := p[ipLen:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 5201)
+	binary.BigEndian.PutUint32(tcp[4:], s.seq)
+	binary.BigEndian.PutUint32(tcp[8:], 777)
+	tcp[12] = byte(20+len(tcpOptions)) / 4 << 4
+	tcp[13] = s.flags
+	binary.BigEndian.PutUint16(tcp[14:], 512)
+	copy(tcp[20:], tcpOptions)
+	copy(tcp[20+len(tcpOptions):], s.payload)
+	binary.BigEndian.PutUint16(tcp[tcpChecksumOffset:], refChecksum(refPseudoHeader(p, tcpLen), tcp))
+	return p
+}
+
+// testPayload returns size bytes of payload that differ from segment to segment
+func testPayload(size int) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i*31 + i/251)
+	}
+	return payload
+}
+
+// gsoHeader returns the virtio_net_hdr the kernel passes with a TCP super-packet
+func gsoHeader(ipv6 bool, gsoSize int) virtioNetHdr {
+	hdr := virtioNetHdr{
+		flags:      unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		gsoType:    unix.VIRTIO_NET_HDR_GSO_TCPV4,
+		gsoSize:    uint16(gsoSize),
+		csumStart:  20,
+		csumOffset: tcpChecksumOffset,
+	}
+	if ipv6 {
+		hdr.gsoType = unix.VIRTIO_NET_HDR_GSO_TCPV6
+		hdr.csumStart = 40
+	}
+	hdr.hdrLen = hdr.csumStart + 20 + uint16(len(tcpOptions))
+	return hdr
+}
+
+// superTCPPacket builds a super-packet as the kernel passes it, with the sum
+// of the pseudo header in place of the TCP checksum
+func superTCPPacket(s tcpSpec) []byte {
+	p := tcpPacket(s)
+	ipLen := 20
+	if s.ipv6 {
+		ipLen = 40
+	}
+	binary.BigEndian.PutUint16(p[ipLen+tcpChecksumOffset:], ^refChecksum(refPseudoHeader(p, len(p)-ipLen)))
+	return p
+}
+
+// expectedSegments splits the payload of a super-packet as the kernel would
+func expectedSegments(s tcpSpec, gsoSize int) [][]byte {
+	var segments [][]byte
+	count := (len(s.payload) + gsoSize - 1) / gsoSize
+	for i := 0; i < count; i++ {
+		end := (i + 1) * gsoSize
+		if end > len(s.payload) {
+			end = len(s.payload)
+		}
+		flags := s.flags
+		if i != count-1 {
+			flags &^= tcpFlagFIN | tcpFlagPSH
+		}
+		if i != 0 {
+			flags &^= tcpFlagCWR
+		}
+		segments = append(segments, tcpPacket(tcpSpec{
+			ipv6:    s.ipv6,
+			id:      s.id + uint16(i),
+			seq:     s.seq + uint32(i*gsoSize),
+			flags:   flags,
+			payload: s.payload[i*gsoSize : end],
+		}))
+	}
+	return segments
+}
+
+// splitAll returns every segment of a super-packet
+func splitAll(t *testing.T, packet []byte, hdr virtioNetHdr) [][]byte {
+	t.Helper()
+	var s superPacket
+	if err := s.reset(packet, &hdr); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	var segments [][]byte
+	bufs, sizes := [][]byte{make([]byte, 1500)}, []int{0}
+	for s.pending() {
+		if s.fill(bufs, sizes) == 1 {
+			segments = append(segments, append([]byte(nil), bufs[0][:sizes[0]]...))
+		}
+	}
+	return segments
+}
+
+func TestSuperPacketSegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    tcpSpec
+		gsoSize int
+	}{
+		{"ipv4 with a short last segment", tcpSpec{id: 100, seq: 1000, flags: tcpFlagACK | tcpFlagPSH, payload: testPayload(3*1400 + 500)}, 1400},
+		{"ipv4 exact multiple", tcpSpec{id: 7, seq: 1, flags: tcpFlagACK, payload: testPayload(4 * 1000)}, 1000},
+		{"ipv4 FIN and CWR", tcpSpec{id: 1, seq: 5, flags: tcpFlagACK | tcpFlagPSH | tcpFlagFIN | tcpFlagCWR, payload: testPayload(2500)}, 1000},
+		{"ipv4 id wraparound", tcpSpec{id: 0xfffe, seq: 9, flags: tcpFlagACK, payload: testPayload(3000)}, 1000},
+		{"ipv4 seq wraparound", tcpSpec{id: 1, seq: 0xffffff00, flags: tcpFlagACK, payload: testPayload(3000)}, 1000},
+		{"ipv4 single segment", tcpSpec{id: 1, seq: 9, flags: tcpFlagACK | tcpFlagPSH, payload: testPayload(300)}, 1000},
+		{"ipv6", tcpSpec{ipv6: true, seq: 42, flags: tcpFlagACK | tcpFlagPSH, payload: testPayload(5*1200 + 1)}, 1200},
+		{"ipv6 odd segment size", tcpSpec{ipv6: true, seq: 42, flags: tcpFlagACK, payload: testPayload(3 * 1001)}, 1001},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitAll(t, superTCPPacket(tt.spec), gsoHeader(tt.spec.ipv6, tt.gsoSize))
+			want := expectedSegments(tt.spec, tt.gsoSize)
+			if len(got) != len(want) {
+				t.Fatalf("got %d segments, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Errorf("segment %d differs from the reference:\n got %x\nwant %x", i, got[i][:60], want[i][:60])
+				}
+			}
+		})
+	}
+}
+
+func TestSuperPacketFillSmallBatches(t *testing.T) {
+	spec := tcpSpec{id: 1, seq: 1, flags: tcpFlagACK, payload: testPayload(10 * 1000)}
+	var s superPacket
+	hdr := gsoHeader(false, 1000)
+	if err := s.reset(superTCPPacket(spec), &hdr); err != nil {
+		t.Fatal(err)
+	}
+	want := expectedSegments(spec, 1000)
+	bufs := [][]byte{make([]byte, 1500), make([]byte, 1500), make([]byte, 1500)}
+	sizes := make([]int, len(bufs))
+	var got [][]byte
+	for s.pending() {
+		n := s.fill(bufs, sizes)
+		for i := 0; i < n; i++ {
+			got = append(got, append([]byte(nil), bufs[i][:sizes[i]]...))
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("segment %d differs from the reference", i)
+		}
+	}
+
+	// Segments that don't fit their buffer are dropped
+	if err := s.reset(superTCPPacket(spec), &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.fill([][]byte{make([]byte, 500)}, sizes); n != 0 || s.pending() {
+		t.Errorf("filled %d segments into a short buffer, pending %v", n, s.pending())
+	}
+}
+
+func TestSuperPacketResetInvalid(t *testing.T) {
+	v4 := superTCPPacket(tcpSpec{flags: tcpFlagACK, payload: testPayload(2000)})
+	tests := []struct {
+		name   string
+		packet []byte
+		hdr    func(*virtioNetHdr)
+	}{
+		{"empty", nil, func(*virtioNetHdr) {}},
+		{"no segment size", v4, func(h *virtioNetHdr) { h.gsoSize = 0 }},
+		{"IPv6 type for IPv4", v4, func(h *virtioNetHdr) { h.gsoType = unix.VIRTIO_NET_HDR_GSO_TCPV6 }},
+		{"checksum start in the IP header", v4, func(h *virtioNetHdr) { h.csumStart = 10 }},
+		{"truncated TCP header", v4[:30], func(*virtioNetHdr) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := gsoHeader(false, 1000)
+			tt.hdr(&hdr)
+			var s superPacket
+			if err := s.reset(tt.packet, &hdr); err == nil {
+				t.Fatalf("reset accepted the packet")
+			}
+			if s.pending() {
+				t.Fatalf("invalid packet left segments")
+			}
+		})
+	}
+}
+
+func TestCoalesceRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    tcpSpec
+		gsoSize int
+	}{
+		{"ipv4", tcpSpec{id: 10, seq: 100, flags: tcpFlagACK | tcpFlagPSH, payload: testPayload(5*1200 + 300)}, 1200},
+		{"ipv4 without push", tcpSpec{id: 10, seq: 100, flags: tcpFlagACK, payload: testPayload(4 * 1200)}, 1200},
+		{"ipv6", tcpSpec{ipv6: true, seq: 0xfffffc00, flags: tcpFlagACK | tcpFlagPSH, payload: testPayload(3*1100 + 7)}, 1100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			super := superTCPPacket(tt.spec)
+			hdr := gsoHeader(tt.spec.ipv6, tt.gsoSize)
+			segments := splitAll(t, super, hdr)
+
+			buf := make([]byte, virtioNetHdrLen+maxSuperPacket)
+			n, merged := coalesce(buf, segments)
+			if merged != len(segments) {
+				t.Fatalf("merged %d of %d segments", merged, len(segments))
+			}
+			var got virtioNetHdr
+			got.decode(buf)
+			if got != hdr {
+				t.Errorf("got header %+v, want %+v", got, hdr)
+			}
+			packet := buf[virtioNetHdrLen:n]
+			// The IPv4 ID is the one of the first segment, as in the original
+			if !bytes.Equal(packet, super) {
+				t.Fatalf("merged packet differs from the original super-packet")
+			}
+
+			// Splitting the merged packet gives the segments again
+			again := splitAll(t, append([]byte(nil), packet...), got)
+			for i := range segments {
+				if !bytes.Equal(again[i], segments[i]) {
+					t.Errorf("segment %d differs after the round trip", i)
+				}
+			}
+
+			// The checksum completed by the kernel is the one of the whole packet
+			if err := completeChecksum(packet, &got); err != nil {
+				t.Fatal(err)
+			}
+			ipLen := int(got.csumStart)
+			tcp := packet[ipLen:]
+			if refChecksum(refPseudoHeader(packet, len(tcp)), tcp) != 0 {
+				t.Errorf("completed checksum of the merged packet is invalid")
+			}
+		})
+	}
+}
+
+func TestCoalesceStops(t *testing.T) {
+	seg := func(seq uint32, flags byte, size int) []byte {
+		return tcpPacket(tcpSpec{id: uint16(seq), seq: seq, flags: flags, payload: testPayload(size)})
+	}
+	// modified changes the headers of an IPv4 segment and computes its checksums again
+	modified := func(p []byte, change func([]byte)) []byte {
+		p = append([]byte(nil), p...)
+		change(p)
+		p[10], p[11] = 0, 0
+		binary.BigEndian.PutUint16(p[10:], refChecksum(p[:20]))
+		tcp := p[20:]
+		tcp[tcpChecksumOffset], tcp[tcpChecksumOffset+1] = 0, 0
+		binary.BigEndian.PutUint16(tcp[tcpChecksumOffset:], refChecksum(refPseudoHeader(p, len(tcp)), tcp))
+		return p
+	}
+	// corrupted flips a bit of a segment, leaving its checksums as they were
+	corrupted := func(p []byte, offset int) []byte {
+		p = append([]byte(nil), p...)
+		p[offset] ^= 0x10
+		return p
+	}
+	ack := byte(tcpFlagACK)
+	tests := []struct {
+		name    string
+		packets [][]byte
+		merged  int
+	}{
+		{"single packet", [][]byte{seg(0, ack, 1000)}, 1},
+		{"pushed first segment", [][]byte{seg(0, ack|tcpFlagPSH, 1000), seg(1000, ack, 1000)}, 1},
+		{"consecutive segments", [][]byte{seg(0, ack, 1000), seg(1000, ack, 1000), seg(2000, ack, 1000)}, 3},
+		{"short segment ends the packet", [][]byte{seg(0, ack, 1000), seg(1000, ack, 400), seg(1400, ack, 1000)}, 2},
+		{"pushed segment ends the packet", [][]byte{seg(0, ack, 1000), seg(1000, ack|tcpFlagPSH, 1000), seg(2000, ack, 1000)}, 2},
+		{"larger segment", [][]byte{seg(0, ack, 1000), seg(1000, ack, 1001)}, 1},
+		{"out of order", [][]byte{seg(0, ack, 1000), seg(2000, ack, 1000)}, 1},
+		{"retransmission", [][]byte{seg(0, ack, 1000), seg(0, ack, 1000)}, 1},
+		{"FIN", [][]byte{seg(0, ack, 1000), seg(1000, ack|tcpFlagFIN, 1000)}, 1},
+		{"SYN", [][]byte{seg(0, ack, 1000), seg(1000, ack|0x02, 1000)}, 1},
+		{"RST", [][]byte{seg(0, ack, 1000), seg(1000, ack|0x04, 1000)}, 1},
+		{"URG", [][]byte{seg(0, ack, 1000), seg(1000, ack|0x20, 1000)}, 1},
+		{"FIN first", [][]byte{seg(0, ack|tcpFlagFIN, 1000), seg(1000, ack, 1000)}, 1},
+		{"no payload", [][]byte{seg(0, ack, 0), seg(0, ack, 0)}, 1},
+		{"other port", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[21]++ })}, 1},
+		{"other destination", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[19]++ })}, 1},
+		{"other TTL", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[8]-- })}, 1},
+		{"other acknowledgment", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[31]++ })}, 1},
+		{"other window", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[35]++ })}, 1},
+		{"other options", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[47]++ })}, 1},
+		{"IPv4 fragment", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[6] = 0x20 })}, 1},
+		{"IPv4 fragment offset", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[7] = 1 })}, 1},
+		{"IPv4 options", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[0] = 0x46 })}, 1},
+		{"IPv4 length mismatch", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[3]-- })}, 1},
+		{"UDP", [][]byte{seg(0, ack, 1000), modified(seg(1000, ack, 1000), func(p []byte) { p[9] = unix.IPPROTO_UDP })}, 1},
+		{"corrupted payload", [][]byte{seg(0, ack, 1000), corrupted(seg(1000, ack, 1000), 500), seg(2000, ack, 1000)}, 1},
+		{"corrupted IPv4 header", [][]byte{seg(0, ack, 1000), corrupted(seg(1000, ack, 1000), 5)}, 1},
+		{"corrupted first segment", [][]byte{corrupted(seg(0, ack, 1000), 500), seg(1000, ack, 1000)}, 1},
+		{"corrupted IPv6 payload", [][]byte{
+			tcpPacket(tcpSpec{ipv6: true, seq: 0, flags: ack, payload: testPayload(1000)}),
+			corrupted(tcpPacket(tcpSpec{ipv6: true, seq: 1000, flags: ack, payload: testPayload(1000)}), 500),
+		}, 1},
+		{"IPv6 after IPv4", [][]byte{seg(0, ack, 1000), tcpPacket(tcpSpec{ipv6: true, seq: 1000, flags: ack, payload: testPayload(1000)})}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, virtioNetHdrLen+maxSuperPacket)
+			n, merged := coalesce(buf, tt.packets)
+			if merged != tt.merged {
+				t.Fatalf("merged %d packets, want %d", merged, tt.merged)
+			}
+			var hdr virtioNetHdr
+			hdr.decode(buf)
+			if merged == 1 {
+				// A packet written alone keeps its checksums and needs no offload
+				if hdr != (virtioNetHdr{}) || !bytes.Equal(buf[virtioNetHdrLen:n], tt.packets[0]) {
+					t.Fatalf("packet written alone was modified, header %+v", hdr)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPSegment(t *testing.T) {
+	v4 := tcpPacket(tcpSpec{flags: tcpFlagACK, payload: testPayload(100)})
+	v6 := tcpPacket(tcpSpec{ipv6: true, flags: tcpFlagACK | tcpFlagPSH, payload: testPayload(100)})
+	modified := func(p []byte, change func([]byte)) []byte {
+		p = append([]byte(nil), p...)
+		change(p)
+		return p
+	}
+	tests := []struct {
+		name          string
+		packet        []byte
+		ipLen, hdrLen int
+		ok            bool
+	}{
+		{"ipv4", v4, 20, 52, true},
+		{"ipv6", v6, 40, 72, true},
+		{"empty", nil, 0, 0, false},
+		{"truncated", v4[:39], 0, 0, false},
+		{"no payload", tcpPacket(tcpSpec{flags: tcpFlagACK}), 0, 0, false},
+		{"IPv6 extension header", modified(v6, func(p []byte) { p[6] = 0 }), 0, 0, false},
+		{"IPv6 length mismatch", modified(v6, func(p []byte) { p[5]++ }), 0, 0, false},
+		{"short TCP header", modified(v4, func(p []byte) { p[32] = 4 << 4 }), 0, 0, false},
+		{"no ACK", modified(v4, func(p []byte) { p[33] = tcpFlagPSH }), 0, 0, false},
+		{"ECE", modified(v4, func(p []byte) { p[33] |= 0x40 }), 0, 0, false},
+		{"not IP", modified(v4, func(p []byte) { p[0] = 0x25 }), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipLen, hdrLen, ok := tcpSegment(tt.packet)
+			if ok != tt.ok || ipLen != tt.ipLen || hdrLen != tt.hdrLen {
+				t.Fatalf("got %d, %d, %v, want %d, %d, %v", ipLen, hdrLen, ok, tt.ipLen, tt.hdrLen, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSetIPLength(t *testing.T) {
+	v4 := tcpPacket(tcpSpec{flags: tcpFlagACK, payload: testPayload(100)})
+	setIPLength(v4, 1000)
+	if length := binary.BigEndian.Uint16(v4[2:]); length != 1000 {
+		t.Errorf("IPv4 length %d, want 1000", length)
+	}
+	if refChecksum(v4[:20]) != 0 {
+		t.Errorf("IPv4 header checksum is invalid")
+	}
+	v6 := tcpPacket(tcpSpec{ipv6: true, flags: tcpFlagACK, payload: testPayload(100)})
+	setIPLength(v6, 1000)
+	if length := binary.BigEndian.Uint16(v6[4:]); length != 960 {
+		t.Errorf("IPv6 payload length %d, want 960", length)
+	}
+}
+
+func TestCompleteChecksum(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		// An odd payload length checks the padding of the last byte
+		want := tcpPacket(tcpSpec{ipv6: ipv6, flags: tcpFlagACK, payload: testPayload(333)})
+		packet := superTCPPacket(tcpSpec{ipv6: ipv6, flags: tcpFlagACK, payload: testPayload(333)})
+		hdr := gsoHeader(ipv6, 0)
+		if err := completeChecksum(packet, &hdr); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(packet, want) {
+			t.Errorf("ipv6 %v: completed checksum differs from the reference", ipv6)
+		}
+		hdr.csumStart = uint16(len(packet) - 1)
+		if err := completeChecksum(packet, &hdr); err == nil {
+			t.Errorf("ipv6 %v: checksum past the packet accepted", ipv6)
+		}
+	}
+}
+
+// withVnetHdr prepends the virtio_net_hdr to packet
+func withVnetHdr(hdr virtioNetHdr, packet []byte) []byte {
+	b := make([]byte, virtioNetHdrLen+len(packet))
+	hdr.encode(b)
+	copy(b[virtioNetHdrLen:], packet)
+	return b
+}
+
+func TestNativeTunReceive(t *testing.T) {
+	spec := tcpSpec{id: 3, seq: 3, flags: tcpFlagACK | tcpFlagPSH, payload: testPayload(5 * 1000)}
+	segments := expectedSegments(spec, 1000)
+	plain := tcpPacket(tcpSpec{flags: tcpFlagACK, payload: testPayload(200)})
+	csum := superTCPPacket(tcpSpec{flags: tcpFlagACK, payload: testPayload(200)})
+	csumHdr := gsoHeader(false, 0)
+	csumHdr.gsoType = unix.VIRTIO_NET_HDR_GSO_NONE
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   [][]byte
+	}{
+		{"plain packet", withVnetHdr(virtioNetHdr{}, plain), [][]byte{plain}},
+		{"checksum offload", withVnetHdr(csumHdr, csum), [][]byte{plain}},
+		{"super-packet", withVnetHdr(gsoHeader(false, 1000), superTCPPacket(spec)), segments},
+		{"truncated header", make([]byte, virtioNetHdrLen), nil},
+		{"unknown GSO type", withVnetHdr(virtioNetHdr{gsoType: unix.VIRTIO_NET_HDR_GSO_UDP}, plain), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &nativeTun{vnetHdr: true}
+			bufs := make([][]byte, 2)
+			for i := range bufs {
+				bufs[i] = make([]byte, 1500)
+			}
+			sizes := make([]int, len(bufs))
+			var got [][]byte
+			n := tun.receive(tt.packet, bufs, sizes)
+			for {
+				for i := 0; i < n; i++ {
+					got = append(got, append([]byte(nil), bufs[i][:sizes[i]]...))
+				}
+				if !tun.split.pending() {
+					break
+				}
+				// The segments left over are returned by the next batch
+				n = tun.split.fill(bufs, sizes)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d packets, want %d", len(got), len(tt.want))
+			}
+			for i := range tt.want {
+				if !bytes.Equal(got[i], tt.want[i]) {
+					t.Errorf("packet %d differs from the reference", i)
+				}
+			}
+		})
+	}
+}
+
+func TestNativeTunReadBatch(t *testing.T) {
+	// A socket pair keeps the boundaries of the packets like a TUN interface
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("no socket pair: %v", err)
+	}
+	peer := os.NewFile(uintptr(fds[1]), "peer")
+	defer peer.Close()
+	file := os.NewFile(uintptr(fds[0]), "tun")
+	defer file.Close()
+	raw, err := file.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := &nativeTun{file: file, raw: raw, vnetHdr: true, readBuf: make([]byte, virtioNetHdrLen+maxSuperPacket)}
+
+	spec := tcpSpec{id: 9, seq: 9, flags: tcpFlagACK | tcpFlagPSH, payload: testPayload(5 * 1000)}
+	plain := tcpPacket(tcpSpec{flags: tcpFlagACK, payload: testPayload(10)})
+	want := append(expectedSegments(spec, 1000), plain)
+	for _, p := range [][]byte{
+		withVnetHdr(gsoHeader(false, 1000), superTCPPacket(spec)),
+		withVnetHdr(virtioNetHdr{}, plain),
+	} {
+		if _, err := peer.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bufs := make([][]byte, 4)
+	for i := range bufs {
+		bufs[i] = make([]byte, 1500)
+	}
+	sizes := make([]int, len(bufs))
+	var got [][]byte
+	for len(got) < len(want) {
+		n, err := tun.ReadBatch(bufs, sizes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			got = append(got, append([]byte(nil), bufs[i][:sizes[i]]...))
+		}
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("packet %d differs from the reference", i)
+		}
+	}
+}
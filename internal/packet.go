@@ -0,0 +1,225 @@
+package quicwire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+)
+
+const (
+	// maxDatagramSize is the largest payload sent in a single QUIC datagram
+	maxDatagramSize = 1190
+
+	// Fragments start with a byte whose high nibble can't begin an IP packet,
+	// and whose low nibble is the version of the fragment format. The header
+	// is that byte, the fragment index and count, and a 16 bit id. The format
+	// is described in the README, a change must bump fragmentVersion.
+	fragmentMarker    = 0xf0
+	fragmentVersion   = 0
+	fragmentHeaderLen = 4
+	maxFragments      = 15
+
+	// maxPendingPackets bounds the packets waiting for missing fragments
+	maxPendingPackets = 64
+)
+
+// packetLength returns the length of an IPv4 or IPv6 packet given by its header
+func packetLength(packet []byte) (int, bool) {
+	if len(packet) == 0 {
+		return 0, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint16(packet[2:4])), true
+	case 6:
+		if len(packet) < 40 {
+			return 0, false
+		}
+		return 40 + int(binary.BigEndian.Uint16(packet[4:6])), true
+	}
+	return 0, false
+}
+
+// packetDestination returns the destination address of an IPv4 or IPv6 packet
+func packetDestination(packet []byte) (netip.Addr, bool) {
+	if len(packet) == 0 {
+		return netip.Addr{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom4([4]byte(packet[16:20])), true
+	case 6:
+		if len(packet) < 40 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom16([16]byte(packet[24:40])), true
+	}
+	return netip.Addr{}, false
+}
+
+// packetSource returns the source address of an IPv4 or IPv6 packet
+func packetSource(packet []byte) (netip.Addr, bool) {
+	if len(packet) == 0 {
+		return netip.Addr{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom4([4]byte(packet[12:16])), true
+	case 6:
+		if len(packet) < 40 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom16([16]byte(packet[8:24])), true
+	}
+	return netip.Addr{}, false
+}
+
+// fragmenter splits packets that don't fit in a single QUIC datagram
+type fragmenter struct {
+	nextID atomic.Uint32
+}
+
+// fragment passes the datagrams needed to carry the packet to send. The
+// fragments are built in scratch, which holds maxDatagramSize bytes and is
+// reused for each of them, so send must not keep the datagram.
+func (f *fragmenter) fragment(packet, scratch []byte, send func([]byte) error) error {
+	if len(packet) <= maxDatagramSize {
+		return send(packet)
+	}
+	chunk := maxDatagramSize - fragmentHeaderLen
+	count := (len(packet) + chunk - 1) / chunk
+	if count > maxFragments {
+		return fmt.Errorf("packet of %d bytes is too large to fragment", len(packet))
+	}
+	id := uint16(f.nextID.Add(1))
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunk
+		if end > len(packet) {
+			end = len(packet)
+		}
+		scratch[0] = fragmentMarker | fragmentVersion
+		scratch[1] = byte(i<<4 | count)
+		binary.BigEndian.PutUint16(scratch[2:], id)
+		n := copy(scratch[fragmentHeaderLen:maxDatagramSize], packet[i*chunk:end])
+		if err := send(scratch[:fragmentHeaderLen+n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingPacket collects the fragments of a packet
+type pendingPacket struct {
+	fragments [maxFragments][]byte
+	count     int
+	received  int
+	size      int
+}
+
+// reassembler rebuilds fragmented packets received over one connection.
+// Datagrams may be lost, so incomplete packets are evicted once too many are
+// pending. Packets larger than the buffers of the pool are dropped.
+type reassembler struct {
+	pending map[uint16]*pendingPacket
+	order   []uint16
+	// free holds the forgotten pendingPackets for reuse
+	free []*pendingPacket
+	// pool holds the buffers of the rebuilt packets
+	pool *packetPool
+}
+
+func newReassembler(pool *packetPool) *reassembler {
+	return &reassembler{pending: make(map[uint16]*pendingPacket), pool: pool}
+}
+
+// add processes a received datagram and returns a complete packet, or nil
+// while fragments are still missing. A packet rebuilt from fragments is held
+// by a buffer of the pool, which is returned too, while an unfragmented
+// packet is the datagram itself.
+func (r *reassembler) add(datagram []byte) ([]byte, *packetBuf, error) {
+	if len(datagram) == 0 || datagram[0]&0xf0 != fragmentMarker {
+		return datagram, nil, nil
+	}
+	if version := datagram[0] & 0x0f; version != fragmentVersion {
+		return nil, nil, fmt.Errorf("unsupported fragment version %d", version)
+	}
+	if len(datagram) < fragmentHeaderLen {
+		return nil, nil, fmt.Errorf("truncated fragment header")
+	}
+	index, count := int(datagram[1]>>4), int(datagram[1]&0x0f)
+	if count == 0 || index >= count {
+		return nil, nil, fmt.Errorf("invalid fragment %d of %d", index, count)
+	}
+	id := binary.BigEndian.Uint16(datagram[2:])
+	p, ok := r.pending[id]
+	if ok && p.count != count {
+		r.forget(id)
+		ok = false
+	}
+	if !ok {
+		if len(r.order) >= maxPendingPackets {
+			r.forget(r.order[0])
+		}
+		p = r.newPending(count)
+		r.pending[id] = p
+		r.order = append(r.order, id)
+	}
+	if p.fragments[index] == nil {
+		p.fragments[index] = datagram[fragmentHeaderLen:]
+		p.received++
+		p.size += len(datagram) - fragmentHeaderLen
+	}
+	// The rebuilt packet is written to the device, whose MTU is the size of
+	// the buffers of the pool
+	if p.size > r.pool.size {
+		r.forget(id)
+		return nil, nil, fmt.Errorf("fragmented packet larger than the MTU of %d bytes", r.pool.size)
+	}
+	if p.received < count {
+		return nil, nil, nil
+	}
+	b := r.pool.get()
+	for _, frag := range p.fragments[:count] {
+		b.n += copy(b.data[b.n:], frag)
+	}
+	r.forget(id)
+	return b.packet(), b, nil
+}
+
+// newPending returns an empty pendingPacket for count fragments
+func (r *reassembler) newPending(count int) *pendingPacket {
+	if len(r.free) == 0 {
+		return &pendingPacket{count: count}
+	}
+	p := r.free[len(r.free)-1]
+	r.free = r.free[:len(r.free)-1]
+	p.count = count
+	return p
+}
+
+// forget drops a pending packet and keeps it for reuse
+func (r *reassembler) forget(id uint16) {
+	p, ok := r.pending[id]
+	if !ok {
+		return
+	}
+	delete(r.pending, id)
+	for i, pid := range r.order {
+		if pid == id {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	*p = pendingPacket{}
+	r.free = append(r.free, p)
+}
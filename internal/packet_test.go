@@ -0,0 +1,283 @@
+package quicwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// largestFragmented is the size of the largest packet carried in fragments
+const largestFragmented = maxFragments * (maxDatagramSize - fragmentHeaderLen)
+
+// testPacket returns a packet of size bytes with a recognizable payload
+func testPacket(size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x60
+	for i := 1; i < size; i++ {
+		packet[i] = byte(i * 7)
+	}
+	return packet
+}
+
+// fragments returns copies of the datagrams carrying packet
+func fragments(t *testing.T, f *fragmenter, packet []byte) [][]byte {
+	t.Helper()
+	var datagrams [][]byte
+	scratch := make([]byte, maxDatagramSize)
+	err := f.fragment(packet, scratch, func(datagram []byte) error {
+		datagrams = append(datagrams, append([]byte(nil), datagram...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fragment: %v", err)
+	}
+	return datagrams
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		fragments int
+	}{
+		{"small", 64, 1},
+		{"datagram size", maxDatagramSize, 1},
+		{"one byte over", maxDatagramSize + 1, 2},
+		{"ipv6 mtu", 1280, 2},
+		{"largest", largestFragmented, maxFragments},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f fragmenter
+			packet := testPacket(tt.size)
+			datagrams := fragments(t, &f, packet)
+			if len(datagrams) != tt.fragments {
+				t.Fatalf("got %d datagrams, want %d", len(datagrams), tt.fragments)
+			}
+			for _, d := range datagrams {
+				if len(d) > maxDatagramSize {
+					t.Fatalf("datagram of %d bytes exceeds %d", len(d), maxDatagramSize)
+				}
+			}
+			if tt.fragments == 1 && !bytes.Equal(datagrams[0], packet) {
+				t.Fatalf("unfragmented packet was modified")
+			}
+
+			r := newReassembler(newPacketPool(largestFragmented))
+			for i, d := range datagrams {
+				got, _, err := r.add(d)
+				if err != nil {
+					t.Fatalf("add fragment %d: %v", i, err)
+				}
+				if i < len(datagrams)-1 {
+					if got != nil {
+						t.Fatalf("packet returned after fragment %d of %d", i, len(datagrams))
+					}
+					continue
+				}
+				if !bytes.Equal(got, packet) {
+					t.Fatalf("reassembled packet differs from the original")
+				}
+			}
+			if len(r.pending) != 0 || len(r.order) != 0 {
+				t.Fatalf("%d packets still pending", len(r.pending))
+			}
+		})
+	}
+}
+
+func TestFragmentTooLarge(t *testing.T) {
+	var f fragmenter
+	size := maxFragments*(maxDatagramSize-fragmentHeaderLen) + 1
+	err := f.fragment(testPacket(size), make([]byte, maxDatagramSize), func([]byte) error {
+		t.Fatalf("datagram sent for a packet that is too large")
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("fragmenting %d bytes succeeded", size)
+	}
+}
+
+func TestFragmentHeader(t *testing.T) {
+	var f fragmenter
+	datagrams := fragments(t, &f, testPacket(3000))
+	if len(datagrams) != 3 {
+		t.Fatalf("got %d datagrams, want 3", len(datagrams))
+	}
+	for i, d := range datagrams {
+		if d[0] != 0xf0 {
+			t.Errorf("fragment %d: first byte %#x, want 0xf0", i, d[0])
+		}
+		if index, count := int(d[1]>>4), int(d[1]&0x0f); index != i || count != 3 {
+			t.Errorf("fragment %d: index %d count %d, want %d and 3", i, index, count, i)
+		}
+		if id := binary.BigEndian.Uint16(d[2:]); id != 1 {
+			t.Errorf("fragment %d: id %d, want 1", i, id)
+		}
+	}
+}
+
+func TestReassembleOutOfOrder(t *testing.T) {
+	var f fragmenter
+	first, second := testPacket(3000), testPacket(2500)
+	a, b := fragments(t, &f, first), fragments(t, &f, second)
+	r := newReassembler(newPacketPool(largestFragmented))
+
+	// The fragments of both packets arrive interleaved and reversed
+	order := [][]byte{a[2], b[1], a[0], b[2]}
+	for i, d := range order {
+		if got, _, err := r.add(d); err != nil || got != nil {
+			t.Fatalf("datagram %d: got %d bytes, %v", i, len(got), err)
+		}
+	}
+	got, _, err := r.add(b[0])
+	if err != nil || !bytes.Equal(got, second) {
+		t.Fatalf("second packet not reassembled: %d bytes, %v", len(got), err)
+	}
+	got, _, err = r.add(a[1])
+	if err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("first packet not reassembled: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestReassembleMissingAndDuplicate(t *testing.T) {
+	var f fragmenter
+	lost, next := testPacket(1280), testPacket(1280)
+	a, b := fragments(t, &f, lost), fragments(t, &f, next)
+	r := newReassembler(newPacketPool(largestFragmented))
+
+	// The second fragment of the first packet is lost, and the first one is duplicated
+	for _, d := range [][]byte{a[0], a[0]} {
+		if got, _, err := r.add(d); err != nil || got != nil {
+			t.Fatalf("got %d bytes, %v", len(got), err)
+		}
+	}
+	if p := r.pending[binary.BigEndian.Uint16(a[0][2:])]; p == nil || p.received != 1 {
+		t.Fatalf("duplicate fragment counted")
+	}
+	for i, d := range b {
+		got, _, err := r.add(d)
+		if err != nil {
+			t.Fatalf("fragment %d: %v", i, err)
+		}
+		if i == len(b)-1 && !bytes.Equal(got, next) {
+			t.Fatalf("packet following a lost fragment not reassembled")
+		}
+	}
+	if len(r.pending) != 1 {
+		t.Fatalf("%d packets pending, want the incomplete one", len(r.pending))
+	}
+}
+
+func TestReassembleIDWraparound(t *testing.T) {
+	var f fragmenter
+	f.nextID.Store(0xfffe)
+	before, after := testPacket(1280), testPacket(1300)
+	a, b := fragments(t, &f, before), fragments(t, &f, after)
+	if id := binary.BigEndian.Uint16(a[0][2:]); id != 0xffff {
+		t.Fatalf("id before the wraparound is %#x", id)
+	}
+	if id := binary.BigEndian.Uint16(b[0][2:]); id != 0 {
+		t.Fatalf("id after the wraparound is %#x", id)
+	}
+
+	r := newReassembler(newPacketPool(largestFragmented))
+	for _, d := range [][]byte{a[0], b[0]} {
+		if got, _, err := r.add(d); err != nil || got != nil {
+			t.Fatalf("got %d bytes, %v", len(got), err)
+		}
+	}
+	if got, _, err := r.add(b[1]); err != nil || !bytes.Equal(got, after) {
+		t.Fatalf("packet after the wraparound not reassembled: %v", err)
+	}
+	if got, _, err := r.add(a[1]); err != nil || !bytes.Equal(got, before) {
+		t.Fatalf("packet before the wraparound not reassembled: %v", err)
+	}
+}
+
+func TestReassembleEviction(t *testing.T) {
+	var f fragmenter
+	r := newReassembler(newPacketPool(largestFragmented))
+	var packets [][][]byte
+	for i := 0; i < maxPendingPackets+1; i++ {
+		datagrams := fragments(t, &f, testPacket(1280))
+		packets = append(packets, datagrams)
+		if got, _, err := r.add(datagrams[0]); err != nil || got != nil {
+			t.Fatalf("packet %d: got %d bytes, %v", i, len(got), err)
+		}
+		if len(r.pending) > maxPendingPackets {
+			t.Fatalf("%d packets pending, limit is %d", len(r.pending), maxPendingPackets)
+		}
+	}
+
+	// The oldest packet was evicted, its last fragment starts a new one
+	if got, _, err := r.add(packets[0][1]); err != nil || got != nil {
+		t.Fatalf("evicted packet reassembled: %d bytes, %v", len(got), err)
+	}
+	// The packets that followed are still complete
+	last := packets[maxPendingPackets]
+	got, _, err := r.add(last[1])
+	if err != nil || got == nil {
+		t.Fatalf("newest packet not reassembled: %v", err)
+	}
+}
+
+func TestReassembleLargerThanMTU(t *testing.T) {
+	var f fragmenter
+	r := newReassembler(newPacketPool(1280))
+	for _, size := range []int{1281, largestFragmented} {
+		datagrams := fragments(t, &f, testPacket(size))
+		var err error
+		for _, d := range datagrams {
+			var got []byte
+			if got, _, err = r.add(d); got != nil {
+				t.Fatalf("packet of %d bytes reassembled", size)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			t.Fatalf("packet of %d bytes accepted", size)
+		}
+		if len(r.pending) != 0 {
+			t.Fatalf("packet of %d bytes left pending", size)
+		}
+	}
+
+	// A packet of the MTU still fits
+	packet := testPacket(1280)
+	var got []byte
+	for _, d := range fragments(t, &f, packet) {
+		var err error
+		if got, _, err = r.add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, packet) {
+		t.Fatalf("packet of the MTU not reassembled")
+	}
+}
+
+func TestReassembleInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		datagram []byte
+	}{
+		{"unknown version", []byte{0xf1, 0x02, 0, 1, 0}},
+		{"truncated header", []byte{0xf0, 0x02}},
+		{"no fragments", []byte{0xf0, 0x00, 0, 1, 0}},
+		{"index past count", []byte{0xf0, 0x22, 0, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReassembler(newPacketPool(largestFragmented))
+			if got, _, err := r.add(tt.datagram); err == nil {
+				t.Fatalf("accepted, got %d bytes", len(got))
+			}
+			if len(r.pending) != 0 {
+				t.Fatalf("invalid fragment left a pending packet")
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package quicwire
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// PeerUpdate describes a change to a peer of a running node. Like wg set, the
+// peer is created if it doesn't exist yet, and fields left nil are unchanged.
+type PeerUpdate struct {
+	// Identity is the public key of the peer, or its certificate name when a CA is used
+	Identity string
+	// Endpoint replaces the address the peer is dialed at, an empty endpoint
+	// leaves it to the peer to connect
+	Endpoint *string
+	// AllowedIPs replaces the prefixes routed to the peer
+	AllowedIPs *[]netip.Prefix
+	// Remove removes the peer and closes its connection, the other fields are ignored
+	Remove bool
+}
+
+// SetPeer adds, updates or removes a peer of the running node. The
+// connections to the other peers are not affected, and updating a peer keeps
+// its connection open.
+func (qn *QuicWire) SetPeer(update PeerUpdate) error {
+	qn.setMu.Lock()
+	defer qn.setMu.Unlock()
+	if !qn.isRunning() {
+		return fmt.Errorf("node is not running")
+	}
+	peer, err := qn.peerFromIdentity(update.Identity)
+	if err != nil {
+		return err
+	}
+	if update.Remove {
+		return qn.removePeer(peer.identity())
+	}
+	if update.Endpoint != nil && *update.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(*update.Endpoint); err != nil {
+			return fmt.Errorf("invalid endpoint %q: %w", *update.Endpoint, err)
+		}
+	}
+	if p := qn.peers.get(peer.identity()); p != nil {
+		return qn.updatePeer(p, update)
+	}
+	if update.Endpoint != nil {
+		peer.endpoint = *update.Endpoint
+	}
+	if update.AllowedIPs != nil {
+		peer.allowedIPs = *update.AllowedIPs
+	}
+	return qn.addPeer(peer)
+}
+
+// AddPeer adds a peer to the running node and starts connecting to it. The
+// peer is validated like the peers of the config, and must not exist yet.
+func (qn *QuicWire) AddPeer(conf PeerConfig) error {
+	qn.setMu.Lock()
+	defer qn.setMu.Unlock()
+	if !qn.isRunning() {
+		return fmt.Errorf("node is not running")
+	}
+	peer, err := parsePeerConfig(&qn.qc.nodeInterface, &conf)
+	if err != nil {
+		return err
+	}
+	return qn.addPeer(peer)
+}
+
+// peerFromIdentity returns an empty peer with the given identity
+func (qn *QuicWire) peerFromIdentity(identity string) (Peer, error) {
+	if qn.qc.nodeInterface.usesCA() {
+		if identity == "" {
+			return Peer{}, fmt.Errorf("peer name is empty")
+		}
+		return Peer{name: identity}, nil
+	}
+	key, err := ParsePublicKey(identity)
+	if err != nil {
+		return Peer{}, err
+	}
+	return Peer{publicKey: key}, nil
+}
+
+// addPeer registers a new peer, routes its AllowedIPs and starts connecting to it
+func (qn *QuicWire) addPeer(peer Peer) error {
+	p := newPeerState(qn.ctx, peer)
+	if err := qn.peers.add(p); err != nil {
+		return err
+	}
+	if err := qn.activatePeer(p); err != nil {
+		qn.peers.remove(p.identity())
+		p.cancel()
+		return errors.Join(err, qn.removePeerRoutes(peer))
+	}
+	qn.logger.Infof("Added peer %s", p.identity())
+	qn.emit(Event{Type: EventPeerAdded, Peer: p.identity()})
+	return nil
+}
+
+// activatePeer installs the routes of a newly registered peer and starts connecting to it
+func (qn *QuicWire) activatePeer(p *peerState) error {
+	if err := qn.installPeerRoutes(*p.config()); err != nil {
+		return err
+	}
+	return qn.startPeer(p)
+}
+
+// updatePeer changes the configuration of a registered peer
+func (qn *QuicWire) updatePeer(p *peerState, update PeerUpdate) error {
+	old := p.config()
+	learned := p.learnedEndpoint.Load()
+	peer := *old
+	if update.Endpoint != nil {
+		peer.endpoint = *update.Endpoint
+	}
+	if update.AllowedIPs != nil {
+		peer.allowedIPs = *update.AllowedIPs
+	}
+	if err := qn.peers.update(peer); err != nil {
+		return err
+	}
+	if err := qn.peerChanged(p, old); err != nil {
+		// Go back to the previous configuration and its routes, so the
+		// registry keeps matching the routes of the kernel
+		if rollbackErr := qn.peers.update(*old); rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+		rollbackErr := qn.peerChanged(p, &peer)
+		p.learnedEndpoint.Store(learned)
+		return errors.Join(err, rollbackErr)
+	}
+	qn.logger.Infof("Updated peer %s", p.identity())
+	qn.emit(Event{Type: EventPeerUpdated, Peer: p.identity()})
+	return nil
+}
+
+// peerChanged applies the new configuration of the peer, which was old,
+// while keeping its connection open. QUIC keepalives of a dialed connection
+// keep the previous PersistentKeepalive until the peer is dialed again.
+func (qn *QuicWire) peerChanged(p *peerState, old *Peer) error {
+	peer := p.config()
+	if peer.endpoint != old.endpoint {
+		// The configured endpoint takes over from the learned one
+		p.learnedEndpoint.Store(nil)
+	}
+	if !equalPrefixes(peer.allowedIPs, old.allowedIPs) {
+		if err := qn.removePeerRoutes(*peer); err != nil {
+			return err
+		}
+		if err := qn.installPeerRoutes(*peer); err != nil {
+			return err
+		}
+	}
+	// Dial the new endpoint right away and pick up the new keepalive
+	p.wake()
+	return nil
+}
+
+// removePeer unregisters the peer, closes its connection and removes its routes
+func (qn *QuicWire) removePeer(identity string) error {
+	p := qn.peers.remove(identity)
+	if p == nil {
+		return fmt.Errorf("peer %s not found", identity)
+	}
+	qn.logger.Infof("Removed peer %s", identity)
+	qn.emit(Event{Type: EventPeerRemoved, Peer: identity})
+	return qn.stopPeer(p)
+}
+
+// stopPeer stops the supervisor of an unregistered peer, closes its
+// connection and removes its routes
+func (qn *QuicWire) stopPeer(p *peerState) error {
+	p.cancel()
+	p.clientMu.Lock()
+	c := p.client.Swap(nil)
+	p.clientMu.Unlock()
+	if c != nil {
+		_ = c.connection.CloseWithError(errCodeUnknownPeer, "peer removed")
+	}
+	return qn.removePeerRoutes(*p.config())
+}
+
+// startPeer starts the supervisor that keeps a connection to the peer, and
+// the sender of its packets
+func (qn *QuicWire) startPeer(p *peerState) error {
+	if p.config().endpoint == "" && qn.disableServer {
+		qn.logger.Warnf("Peer %s has no Endpoint and the server is disabled, it can't be reached", p.identity())
+	}
+	if !qn.disableClient {
+		// Peers without Endpoint are dialed once their address is learned
+		qn.logger.Debugf("Starting client for peer %s", p.identity())
+		tlsConf, err := qn.clientTLSConfig(*p.config())
+		if err != nil {
+			return err
+		}
+		p.tlsConf = tlsConf
+	}
+	qn.wg.Add(2)
+	go func() {
+		defer qn.wg.Done()
+		qn.supervise(p)
+	}()
+	go func() {
+		defer qn.wg.Done()
+		qn.sendToPeer(p)
+	}()
+	return nil
+}
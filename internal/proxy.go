@@ -0,0 +1,378 @@
+package quicwire
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHandshakeTimeout bounds the request of a proxy client
+	proxyHandshakeTimeout = 30 * time.Second
+	// proxyDialTimeout bounds the connection through the tunnel of a proxy client
+	proxyDialTimeout = 30 * time.Second
+)
+
+// SOCKS5 protocol values, RFC 1928
+const (
+	socks5Version        = 0x05
+	socks5NoAuth         = 0x00
+	socks5NoAcceptable   = 0xff
+	socks5Connect        = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5Succeeded      = 0x00
+	socks5HostUnreach    = 0x04
+	socks5CmdUnsupported = 0x07
+	socks5AddrUnsupport  = 0x08
+)
+
+// ServeSOCKS5 accepts SOCKS5 clients on address of the host and connects them
+// through the userspace TCP/IP stack until the node stops. Only CONNECT is
+// supported, without authentication, so address should not be reachable by
+// other hosts. Domain names are resolved with net.DefaultResolver, so their
+// DNS queries leak outside of the tunnel. It must be called after Start with
+// the netstack enabled.
+func (qn *QuicWire) ServeSOCKS5(address string) error {
+	listener, err := qn.proxyListen(address)
+	if err != nil {
+		return err
+	}
+	qn.logger.Infof("Listening for SOCKS5 clients on %s", listener.Addr())
+	qn.serveProxy(listener, func(conn net.Conn) {
+		qn.handleSOCKS5(conn)
+	})
+	return nil
+}
+
+// ServeHTTPProxy accepts HTTP proxy clients on address of the host and
+// forwards their requests through the userspace TCP/IP stack until the node
+// stops. CONNECT tunnels and plain HTTP requests are supported, without
+// authentication. It must be called after Start with the netstack enabled.
+func (qn *QuicWire) ServeHTTPProxy(address string) error {
+	listener, err := qn.proxyListen(address)
+	if err != nil {
+		return err
+	}
+	qn.logger.Infof("Listening for HTTP proxy clients on %s", listener.Addr())
+	transport := &http.Transport{
+		DialContext:         qn.netstack.DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	server := &http.Server{
+		Handler:           &httpProxy{qn: qn, transport: transport},
+		ReadHeaderTimeout: proxyHandshakeTimeout,
+	}
+	qn.wg.Add(2)
+	go func() {
+		defer qn.wg.Done()
+		<-qn.ctx.Done()
+		server.Close()
+		transport.CloseIdleConnections()
+	}()
+	go func() {
+		defer qn.wg.Done()
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			qn.logger.Errorf("HTTP proxy failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// proxyListen listens on address of the host for the clients of a proxy
+func (qn *QuicWire) proxyListen(address string) (net.Listener, error) {
+	if qn.netstack == nil {
+		return nil, fmt.Errorf("proxies need the netstack mode")
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on proxy address %s: %w", address, err)
+	}
+	return listener, nil
+}
+
+// serveProxy passes the connections accepted on listener to handle until the
+// node stops, then closes them
+func (qn *QuicWire) serveProxy(listener net.Listener, handle func(net.Conn)) {
+	var connsMu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+
+	qn.wg.Add(2)
+	go func() {
+		defer qn.wg.Done()
+		<-qn.ctx.Done()
+		listener.Close()
+		connsMu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		connsMu.Unlock()
+	}()
+	go func() {
+		defer qn.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if qn.ctx.Err() == nil {
+					qn.logger.Errorf("Failed to accept proxy connection: %v", err)
+				}
+				return
+			}
+			connsMu.Lock()
+			if qn.ctx.Err() != nil {
+				connsMu.Unlock()
+				conn.Close()
+				return
+			}
+			conns[conn] = struct{}{}
+			connsMu.Unlock()
+			qn.wg.Add(1)
+			go func() {
+				defer qn.wg.Done()
+				handle(conn)
+				connsMu.Lock()
+				delete(conns, conn)
+				connsMu.Unlock()
+			}()
+		}
+	}()
+}
+
+// dialTunnel connects to address through the userspace TCP/IP stack
+func (qn *QuicWire) dialTunnel(ctx context.Context, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, proxyDialTimeout)
+	defer cancel()
+	return qn.netstack.DialContext(ctx, "tcp", address)
+}
+
+// handleSOCKS5 serves a single SOCKS5 client
+func (qn *QuicWire) handleSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	r := bufio.NewReader(conn)
+
+	// Greeting: version, number of methods, methods
+	var greeting [2]byte
+	if _, err := io.ReadFull(r, greeting[:]); err != nil {
+		return
+	}
+	if greeting[0] != socks5Version {
+		qn.logger.Debugf("SOCKS5 client %s uses version %d", conn.RemoteAddr(), greeting[0])
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil || method == socks5NoAcceptable {
+		return
+	}
+
+	// Request: version, command, reserved, address
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	if header[0] != socks5Version {
+		return
+	}
+	address, err := readSOCKS5Address(r, header[3])
+	if err != nil {
+		qn.logger.Debugf("SOCKS5 client %s: %v", conn.RemoteAddr(), err)
+		socks5Reply(conn, socks5AddrUnsupport)
+		return
+	}
+	if header[1] != socks5Connect {
+		socks5Reply(conn, socks5CmdUnsupported)
+		return
+	}
+
+	remote, err := qn.dialTunnel(qn.ctx, address)
+	if err != nil {
+		qn.logger.Debugf("SOCKS5 client %s failed to connect to %s: %v", conn.RemoteAddr(), address, err)
+		socks5Reply(conn, socks5HostUnreach)
+		return
+	}
+	defer remote.Close()
+	if err := socks5Reply(conn, socks5Succeeded); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	// Data the client sent along with its request is buffered in r
+	proxyCopy(qn.ctx, conn, r, remote)
+}
+
+// readSOCKS5Address reads the destination of a SOCKS5 request
+func readSOCKS5Address(r io.Reader, addrType byte) (string, error) {
+	var host string
+	switch addrType {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addrType == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", addrType)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socks5Reply answers a SOCKS5 request. The bound address is not meaningful
+// for a connection through the tunnel, so it is always zero.
+func socks5Reply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// proxyCopy copies data in both directions between a client, read through
+// clientReader, and a connection through the tunnel until both are done or
+// ctx is cancelled
+func proxyCopy(ctx context.Context, client net.Conn, clientReader io.Reader, remote net.Conn) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+			remote.Close()
+		case <-finished:
+		}
+	}()
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(remote, clientReader)
+		closeWrite(remote)
+	}()
+	_, _ = io.Copy(client, remote)
+	closeWrite(client)
+	<-done
+}
+
+// closeWrite shuts down the writing side of conn, or closes it when it
+// can't be half closed
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// httpProxy forwards the requests of HTTP proxy clients through the tunnel
+type httpProxy struct {
+	qn        *QuicWire
+	transport *http.Transport
+}
+
+// hopHeaders are only meaningful between the client and the proxy
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, along with those the
+// Connection header names as hop-by-hop, RFC 9110 section 7.6.1
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		p.connect(w, req)
+		return
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		http.Error(w, "only absolute http URLs are proxied", http.StatusBadRequest)
+		return
+	}
+
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		p.qn.logger.Debugf("HTTP proxy client %s failed to reach %s: %v", req.RemoteAddr, req.URL.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// connect tunnels a CONNECT request to its destination
+func (p *httpProxy) connect(w http.ResponseWriter, req *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be hijacked", http.StatusInternalServerError)
+		return
+	}
+	remote, err := p.qn.dialTunnel(req.Context(), req.Host)
+	if err != nil {
+		p.qn.logger.Debugf("HTTP proxy client %s failed to connect to %s: %v", req.RemoteAddr, req.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+	client, rw, err := hijacker.Hijack()
+	if err != nil {
+		p.qn.logger.Debugf("Failed to hijack HTTP proxy connection: %v", err)
+		return
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Time{})
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	proxyCopy(p.qn.ctx, client, rw.Reader, remote)
+}
@@ -0,0 +1,176 @@
+package quicwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// proxyAddress returns a TCP address of the loopback interface that isn't in use
+func proxyAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// startEchoPair starts a pair of netstack nodes, the second one echoing the
+// TCP connections to port 8000
+func startEchoPair(t *testing.T) (*testNode, *testNode) {
+	a, b := startNetstackPair(t)
+	listener, err := b.qw.Netstack().Listen("tcp", ":8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTCP(t, listener)
+	return a, b
+}
+
+func TestSOCKS5(t *testing.T) {
+	a, b := startEchoPair(t)
+	address := proxyAddress(t)
+	if err := a.qw.ServeSOCKS5(address); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		dst  netip.Addr
+	}{
+		{"ipv4", b.v4},
+		{"ipv6", b.v6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if _, err := conn.Write([]byte{socks5Version, 1, socks5NoAuth}); err != nil {
+				t.Fatal(err)
+			}
+			var method [2]byte
+			if _, err := io.ReadFull(conn, method[:]); err != nil {
+				t.Fatal(err)
+			}
+			if method != [2]byte{socks5Version, socks5NoAuth} {
+				t.Fatalf("got method %v", method)
+			}
+
+			addrType := byte(socks5AddrIPv4)
+			if tt.dst.Is6() {
+				addrType = socks5AddrIPv6
+			}
+			request := append([]byte{socks5Version, socks5Connect, 0, addrType}, tt.dst.AsSlice()...)
+			request = binary.BigEndian.AppendUint16(request, 8000)
+			if _, err := conn.Write(request); err != nil {
+				t.Fatal(err)
+			}
+			var reply [10]byte
+			if _, err := io.ReadFull(conn, reply[:]); err != nil {
+				t.Fatal(err)
+			}
+			if reply[1] != socks5Succeeded {
+				t.Fatalf("got reply %d", reply[1])
+			}
+			expectEcho(t, conn, []byte("hello "+tt.name))
+		})
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	a, b := startEchoPair(t)
+	address := proxyAddress(t)
+	if err := a.qw.ServeHTTPProxy(address); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	target := net.JoinHostPort(b.v4.String(), "8000")
+	if _, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s", resp.Status)
+	}
+	if r.Buffered() != 0 {
+		t.Fatalf("%d bytes after the response", r.Buffered())
+	}
+	expectEcho(t, conn, []byte("hello"))
+}
+
+func TestHTTPProxyHopHeaders(t *testing.T) {
+	a, b := startNetstackPair(t)
+	listener, err := b.qw.Netstack().Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Hop") != "" || req.Header.Get("Keep-Alive") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Connection", "X-Server-Hop")
+		w.Header().Set("X-Server-Hop", "1")
+		w.Header().Set("X-End", "1")
+	})}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { server.Close() })
+
+	address := proxyAddress(t)
+	if err := a.qw.ServeHTTPProxy(address); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+b.v4.String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "X-Hop, keep-alive")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Written as a proxy request, with the absolute URL
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s, hop-by-hop headers were forwarded", resp.Status)
+	}
+	if resp.Header.Get("X-Server-Hop") != "" {
+		t.Errorf("hop-by-hop header of the response was forwarded")
+	}
+	if resp.Header.Get("X-End") == "" {
+		t.Errorf("end-to-end header of the response was dropped")
+	}
+}
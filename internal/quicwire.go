@@ -4,24 +4,54 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quic-go/quic-go"
-	"github.com/songgao/water"
 	"go.uber.org/zap"
 )
 
 const (
-	retryInterval = 5 * time.Second
-	retries       = 10
-	tunDevMTU     = 1190
+	retryInterval    = 5 * time.Second
+	maxRetryInterval = time.Minute
+	retries          = 10
+	// failedRetryInterval is the pause before dialing a peer again once every retry failed
+	failedRetryInterval = 2 * time.Minute
+	tunDevMTU           = 1190
+	// tunDevMTUIPv6 is the minimum MTU of a link carrying IPv6, packets larger
+	// than a single QUIC datagram are fragmented
+	tunDevMTUIPv6 = 1280
+	// simultaneousDialWindow is how recent a connection must be to win over a
+	// new connection to the same peer. Older connections are replaced, since the
+	// peer only dials again when it lost them.
+	simultaneousDialWindow = 10 * time.Second
+	// migrationCheckInterval is how often the address of a connection is
+	// checked for a migration of the peer
+	migrationCheckInterval = time.Second
+	// defaultIdleTimeout is the idle timeout of QUIC connections when IdleTimeout isn't set
+	defaultIdleTimeout = 30 * time.Second
+)
+
+const (
+	// errCodeUnknownPeer closes connections whose identity matches no configured peer
+	errCodeUnknownPeer quic.ApplicationErrorCode = 0x1
+	// errCodeShutdown closes connections when the node stops
+	errCodeShutdown quic.ApplicationErrorCode = 0x2
+	// errCodeDuplicate closes a connection superseded by another one to the same peer
+	errCodeDuplicate quic.ApplicationErrorCode = 0x3
 )
 
 type packetContext struct {
-	localIf *water.Interface
-	quic.Connection
+	localIf Device
+	*quic.Conn
+	// peer that sent the packet
+	peer *peerState
 	Data []byte
+	// buf is the buffer of the packet pool holding Data, or nil
+	buf *packetBuf
 }
 
 // QuicWire struct holds state need to enable connectivity to peers
@@ -29,9 +59,44 @@ type QuicWire struct {
 	qc         *QuicConf
 	logger     *zap.SugaredLogger
 	configFile string
+	// config given to UseConfig, read instead of the config file
+	config *Config
 
 	// QuicNet state data
-	localIf *water.Interface
+	localIf Device
+	// device given to UseDevice, which replaces the TUN interface
+	device  Device
+	udpConn *net.UDPConn
+	// transport multiplexes the server and the dialed connections on udpConn
+	transport *quic.Transport
+
+	//Userspace TCP/IP stack terminating the tunnel, enabled by EnableNetstack
+	useNetstack bool
+	//Skips the STUN requests on start, set by DisableSTUN
+	disableSTUN bool
+	netstack    *Netstack
+
+	//Buffers of the forwarded packets, sized to the MTU of the device
+	pool *packetPool
+	//Packets received from the peers waiting to be written to the device
+	deviceQueue chan devicePacket
+
+	//Context of the node, created with it and cancelled by Stop or by the
+	//context given to Start
+	ctx    context.Context
+	cancel context.CancelFunc
+	//Goroutines of the running node, Start's caller waits on it
+	wg       *sync.WaitGroup
+	stopOnce sync.Once
+	//Held by Start, so Stop doesn't tear down what Start is setting up
+	startMu sync.Mutex
+	//Set once Start succeeded, it publishes the config and the interface of
+	//the node to the methods called from other goroutines
+	running atomic.Bool
+
+	//Every open connection to a peer, closed on Stop
+	connsMu sync.Mutex
+	conns   map[*quic.Conn]struct{}
 
 	//NAT port binding determined through stun request
 	portBinding string
@@ -39,8 +104,29 @@ type QuicWire struct {
 	//Flag to indicate if node is behind Symmetric NAT
 	symmetricNAT bool
 
-	connections   map[string]quic.Connection
-	clients       map[string]*Client
+	//Peers with their connections and routes
+	peers *peerRegistry
+
+	//Public key of the node certificate, breaks ties between simultaneous dials
+	localKeyInfo []byte
+
+	//Serializes the changes of the peers made at runtime
+	setMu sync.Mutex
+
+	//Kernel routes installed for the peers, mapped to the peer identity
+	routesMu     sync.Mutex
+	kernelRoutes map[netip.Prefix]string
+
+	//Path of the control socket, disabled when empty
+	controlSocket string
+
+	//Events of the node, read through Events
+	events chan Event
+
+	//Error that stopped the node, returned by Err
+	failMu  sync.Mutex
+	failErr error
+
 	disableClient bool
 	disableServer bool
 }
@@ -48,6 +134,7 @@ type QuicWire struct {
 // NewQuicWire creates a new QuicWire
 func NewQuicWire(logger *zap.SugaredLogger,
 	configFile string,
+	controlSocket string,
 	disableClient bool,
 	disableServer bool) (*QuicWire, error) {
 
@@ -55,179 +142,422 @@ func NewQuicWire(logger *zap.SugaredLogger,
 		qc:            &QuicConf{},
 		logger:        logger,
 		configFile:    configFile,
-		connections:   make(map[string]quic.Connection),
-		clients:       make(map[string]*Client),
+		conns:         make(map[*quic.Conn]struct{}),
+		peers:         newPeerRegistry(),
+		kernelRoutes:  make(map[netip.Prefix]string),
+		controlSocket: controlSocket,
+		events:        make(chan Event, eventQueue),
 		disableClient: disableClient,
 		disableServer: disableServer,
 	}
+	qn.ctx, qn.cancel = context.WithCancel(context.Background())
 	return qn, nil
 }
 
-// Start Initializes the QuicWire network
+// UseConfig makes the node read its configuration from conf instead of the
+// config file, it must be called before Start. The config file name only
+// names the configuration in errors and logs. conf is validated right away.
+func (qn *QuicWire) UseConfig(conf Config) error {
+	if err := parseConfig(&QuicConf{}, qn.configFile, &conf); err != nil {
+		return err
+	}
+	qn.config = &conf
+	return nil
+}
+
+// readConfig reads the configuration given to UseConfig, or the config file
+func (qn *QuicWire) readConfig(qc *QuicConf) error {
+	if qn.config != nil {
+		return parseConfig(qc, qn.configFile, qn.config)
+	}
+	return readQuicConf(qc, qn.configFile)
+}
+
+// UseDevice makes the node exchange packets with dev instead of creating a
+// TUN interface, it must be called before Start. The addresses of the
+// interface aren't assigned and no routes are installed: the owner of dev
+// routes the packets to it. The node closes dev when it stops.
+func (qn *QuicWire) UseDevice(dev Device) {
+	qn.device = dev
+}
+
+// EnableNetstack makes the node terminate the tunnel in a userspace TCP/IP
+// stack instead of a TUN interface, it must be called before Start. The stack
+// gets the LocalEndpoint addresses, and the mesh is reached through the
+// Netstack returned by Netstack, so the node needs no privileges.
+func (qn *QuicWire) EnableNetstack() {
+	qn.useNetstack = true
+}
+
+// DisableSTUN keeps the node from asking the public STUN servers for its
+// address on Start, which waits for them to answer or time out. It must be
+// called before Start.
+func (qn *QuicWire) DisableSTUN() {
+	qn.disableSTUN = true
+}
+
+// Netstack returns the userspace TCP/IP stack of the node, nil until Start
+// succeeded or when EnableNetstack wasn't called
+func (qn *QuicWire) Netstack() *Netstack {
+	if !qn.running.Load() {
+		return nil
+	}
+	return qn.netstack
+}
+
+// Start Initializes the QuicWire network. The node runs until Stop is called
+// or ctx is cancelled, and its goroutines are tracked by wg.
 func (qn *QuicWire) Start(ctx context.Context, wg *sync.WaitGroup) error {
+	qn.startMu.Lock()
+	defer qn.startMu.Unlock()
+	if qn.ctx.Err() != nil {
+		return fmt.Errorf("node was stopped")
+	}
+	stopParent := context.AfterFunc(ctx, qn.cancel)
+	qn.wg = wg
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-qn.ctx.Done()
+		stopParent()
+		qn.Stop()
+	}()
+
 	qn.logger.Info("QuicWire Starting")
 	qn.logger.Infof("Read the quic config file : %s", qn.configFile)
-	err := readQuicConf(qn.qc, qn.configFile)
+	err := qn.readConfig(qn.qc)
 	if err != nil {
 		return err
 	}
 	qn.logger.Debugf("QuicWire config: %v", qn.qc)
-	qn.logger.Info("Create tunnel interface on local host")
-	if err := qn.createTunIface(); err != nil {
-		return err
+	for _, warning := range qn.qc.warnings {
+		qn.logger.Warnf("%s: %s", qn.configFile, warning)
+	}
+	for _, o := range qn.qc.allowedIPOverlaps() {
+		qn.logger.Warnf("AllowedIPs %s of peer %s overlaps %s of peer %s, the longest prefix wins",
+			o.prefix, o.peer, o.otherPrefix, o.otherPeer)
+	}
+	for _, peer := range qn.qc.peers {
+		if err := qn.peers.add(newPeerState(qn.ctx, peer)); err != nil {
+			return err
+		}
 	}
 
-	//find port binding
-	if !qn.disableServer {
+	// The control socket and the UDP port are taken before any hook, interface
+	// or route is touched: when another node holds them, these belong to it.
+	var control net.Listener
+	if qn.controlSocket != "" {
+		control, err = qn.listenControl()
+		if err != nil {
+			return err
+		}
+	}
+	//find port binding, the STUN requests are sent from the port of the node
+	if !qn.disableServer && !qn.disableSTUN {
 		qn.findPortBinding()
 	}
+	if err := qn.listenUDP(); err != nil {
+		return err
+	}
+
+	if err := qn.runHooks("PreUp", qn.qc.nodeInterface.preUp); err != nil {
+		return err
+	}
+	if qn.useNetstack {
+		ns, err := NewNetstack(qn.qc.nodeInterface.localEndpoint, qn.tunMTU())
+		if err != nil {
+			return err
+		}
+		qn.netstack = ns
+		qn.device = ns
+	}
+	if qn.device != nil {
+		qn.localIf = qn.device
+	} else {
+		qn.logger.Info("Create tunnel interface on local host")
+		if err := qn.createTunIface(); err != nil {
+			return err
+		}
+	}
+	qn.pool = newPacketPool(qn.localIf.MTU())
+	qn.deviceQueue = make(chan devicePacket, deviceQueueLen)
+	for _, p := range qn.peers.all() {
+		// The other peers keep working, and the peer is still reached over
+		// the routes that were installed
+		if err := qn.installPeerRoutes(*p.config()); err != nil {
+			qn.logger.Errorf("Failed to route the AllowedIPs of peer %s: %v", p.identity(), err)
+			qn.reportPeerError(p, err)
+		}
+	}
+	if err := qn.runHooks("PostUp", qn.qc.nodeInterface.postUp); err != nil {
+		return err
+	}
 
 	// Start the server
-	qn.setupTunnel(wg, qn.disableClient, qn.disableServer)
+	if err := qn.setupTunnel(qn.disableServer); err != nil {
+		return err
+	}
 
-	qn.enableTrafficForwarding()
+	qn.wg.Add(2)
+	go func() {
+		defer qn.wg.Done()
+		qn.forwardFromDevice()
+	}()
+	go func() {
+		defer qn.wg.Done()
+		qn.writeToDevice()
+	}()
+
+	qn.running.Store(true)
+	if control != nil {
+		qn.serveControl(control)
+	}
 	return nil
 }
 
-// Stop stops the QuicWire network
+// isRunning reports whether Start succeeded and the node didn't stop since
+func (qn *QuicWire) isRunning() bool {
+	return qn.running.Load() && qn.ctx.Err() == nil
+}
+
+// Stop stops the QuicWire network. It closes the connections to the peers,
+// removes the routes and addresses of the tunnel interface and closes it,
+// which ends every goroutine started by Start.
 func (qn *QuicWire) Stop() {
-	qn.logger.Info("QuicWire Stop")
+	qn.stopOnce.Do(func() {
+		qn.logger.Info("QuicWire Stop")
+		qn.cancel()
+		qn.startMu.Lock()
+		defer qn.startMu.Unlock()
+
+		qn.connsMu.Lock()
+		conns := make([]*quic.Conn, 0, len(qn.conns))
+		for conn := range qn.conns {
+			conns = append(conns, conn)
+		}
+		qn.connsMu.Unlock()
+		for _, conn := range conns {
+			if err := conn.CloseWithError(errCodeShutdown, "shutdown"); err != nil {
+				qn.logger.Debugf("Failed to close connection to %v: %v", conn.RemoteAddr(), err)
+			}
+		}
+
+		if qn.localIf != nil {
+			if err := qn.runHooks("PreDown", qn.qc.nodeInterface.preDown); err != nil {
+				qn.logger.Error(err)
+			}
+			if err := qn.removeAllRoutes(); err != nil {
+				qn.logger.Errorf("Failed to remove routes: %v", err)
+			}
+			if qn.device == nil {
+				if err := qn.cleanupTunIface(); err != nil {
+					qn.logger.Errorf("Failed to clean up TUN interface: %v", err)
+				}
+			}
+			if err := qn.localIf.Close(); err != nil {
+				qn.logger.Errorf("Failed to close TUN interface: %v", err)
+			}
+			if err := qn.runHooks("PostDown", qn.qc.nodeInterface.postDown); err != nil {
+				qn.logger.Error(err)
+			}
+		}
+		if qn.transport != nil {
+			if err := qn.transport.Close(); err != nil {
+				qn.logger.Errorf("Failed to close QUIC transport: %v", err)
+			}
+		}
+		if qn.udpConn != nil {
+			if err := qn.udpConn.Close(); err != nil {
+				qn.logger.Errorf("Failed to close UDP socket: %v", err)
+			}
+		}
+	})
+}
+
+// fail stops the node because of an error it can't recover from, which is
+// then returned by Err
+func (qn *QuicWire) fail(err error) {
+	qn.failMu.Lock()
+	if qn.failErr == nil {
+		qn.failErr = err
+	}
+	qn.failMu.Unlock()
+	qn.logger.Errorf("Stopping the node: %v", err)
+	qn.emit(Event{Type: EventNodeFailed, Err: err})
+	qn.cancel()
 }
 
-func (qn *QuicWire) findPortBinding() (string, error) {
+// Done is closed once the node stops, because Stop was called, the context
+// given to Start was cancelled or the node failed
+func (qn *QuicWire) Done() <-chan struct{} {
+	return qn.ctx.Done()
+}
+
+// Err returns the error that stopped the node, or nil
+func (qn *QuicWire) Err() error {
+	qn.failMu.Lock()
+	defer qn.failMu.Unlock()
+	return qn.failErr
+}
+
+// receive passes the packets received from peer over conn to the handler
+// until the connection is closed
+func (qn *QuicWire) receive(conn *quic.Conn, peer *peerState, handler Handler) {
+	qn.connsMu.Lock()
+	qn.conns[conn] = struct{}{}
+	qn.connsMu.Unlock()
+	if qn.ctx.Err() != nil {
+		// Stop may have already closed the other connections
+		_ = conn.CloseWithError(errCodeShutdown, "shutdown")
+	}
 
+	qn.wg.Add(1)
+	go func() {
+		defer qn.wg.Done()
+		err := handleMsg(qn.localIf, conn, peer, qn.pool, handler)
+		if err != nil && !closedByShutdown(err) && !closedAsDuplicate(err) {
+			qn.logger.Warnf("Connection to peer %s closed: %v", peer.identity(), err)
+		}
+		qn.connsMu.Lock()
+		delete(qn.conns, conn)
+		qn.connsMu.Unlock()
+	}()
+}
+
+// findPortBinding finds the address and port the node is reachable at from
+// outside of its NAT. There is none when the NAT is symmetric, or when no
+// STUN server answers, which only keeps the node from logging its address.
+func (qn *QuicWire) findPortBinding() {
+	qn.logger.Debugf("Querying STUN servers %s and %s", stunServer1, stunServer2)
 	isSymmetric, err := IsSymmetricNAT(qn.qc.nodeInterface.listenPort)
 	if err != nil {
 		qn.logger.Error(err)
 	}
 	if isSymmetric {
 		qn.logger.Warn("Node is behind Symmetric NAT")
-		return "", fmt.Errorf("node is behind Symmetric NAT")
+		qn.symmetricNAT = true
+		return
 	}
 
 	res, err := GetPortBinding(qn.qc.nodeInterface.listenPort)
 	if err != nil {
-		qn.logger.Fatalf("stun request failed: %v", err)
+		qn.logger.Warnf("Failed to find the public address of the node: %v", err)
+		return
 	}
 	qn.logger.Infof("Port binding returned by STUN request: %s", res)
-	return res, nil
+	qn.portBinding = res
 }
 
-func (qn *QuicWire) setupTunnel(wg *sync.WaitGroup, disableClient bool, disableServer bool) {
-	// Create a shared UDP socket
-	localipPortStr := fmt.Sprintf("%s:%d", qn.qc.nodeInterface.localNodeIP, qn.qc.nodeInterface.listenPort)
-	udpAddr, err := net.ResolveUDPAddr("udp4", localipPortStr)
+// listenUDP creates the UDP socket shared by the server and the connections
+// to the peers
+func (qn *QuicWire) listenUDP() error {
+	localipPortStr := net.JoinHostPort(qn.qc.nodeInterface.localNodeIP, strconv.Itoa(qn.qc.nodeInterface.listenPort))
+	udpAddr, err := net.ResolveUDPAddr("udp", localipPortStr)
 	if err != nil {
-		qn.logger.Fatalf("Failed to resolve UDP address: %v", err)
+		return fmt.Errorf("failed to resolve UDP address: %w", err)
 	}
-	udpConn, err := net.ListenUDP("udp4", udpAddr)
+	udpConn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
-		qn.logger.Fatalf("Failed to create shared UDP socket: %v", err)
+		return fmt.Errorf("failed to create shared UDP socket: %w", err)
+	}
+	qn.udpConn = udpConn
+	qn.transport = &quic.Transport{Conn: udpConn}
+	return nil
+}
+
+func (qn *QuicWire) setupTunnel(disableServer bool) error {
+	localKeyInfo, err := qn.qc.nodeInterface.publicKeyInfo()
+	if err != nil {
+		return err
 	}
+	qn.localKeyInfo = localKeyInfo
+
+	localipPortStr := qn.udpConn.LocalAddr().String()
 
 	if !disableServer {
-		wg.Add(1)
+		tlsConf, err := qn.serverTLSConfig()
+		if err != nil {
+			return err
+		}
+		qn.logger.Infof("Starting server on %s", localipPortStr)
+		// The listener config is shared by every peer, the keepalive of
+		// accepted connections is sent by the supervisor of each peer
+		s := NewServer(localipPortStr, tlsConf, qn.quicConfig(0), qn.logger)
+		s.SetHandler(qn.handlePacket)
+		if err := s.Listen(qn.transport); err != nil {
+			return err
+		}
+		qn.wg.Add(1)
 		go func() {
 			// server mode
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
-
-			qn.logger.Infof("Starting server on %s", localipPortStr)
-			s := NewServer(localipPortStr, qn.localIf, qn.logger)
-			s.SetHandler(func(c packetContext) error {
-				msg := c.Data
-				qn.logger.Debugf("Client [ %s ] sent a message [ %v ] over client initiated connection", c.RemoteAddr().String(), msg)
-				c.localIf.Write(c.Data)
-				return nil
-			})
-			qn.logger.Fatal(s.StartServer(ctx, udpConn, qn, wg))
+			defer qn.wg.Done()
+			if err := s.StartServer(qn.ctx, qn, qn.wg); err != nil {
+				qn.fail(fmt.Errorf("server failed: %w", err))
+			}
 		}()
-		wg.Wait()
 	}
 
-	if !disableClient {
-
-		//range over all peers and create client connections
-		for _, peer := range qn.qc.peers {
-			qn.logger.Debugf("Starting client for peer %s", peer.endpoint)
-			go func(peer Peer) {
-
-				_, ok := qn.clients[peer.allowedIPs[0]]
-				if ok {
-					qn.logger.Infof("Client already exists for peer %s [ %s ]", peer.endpoint, peer.allowedIPs[0])
-					return
-				}
-
-				ctx, cancel := context.WithCancel(context.Background())
-				defer cancel()
-
-				c := NewClient(peer.endpoint, qn.qc.nodeInterface.localNodeIP, qn.qc.nodeInterface.listenPort, qn.localIf, qn.logger)
-
-				//split endpoint to get ip and port
-				host, _, err := net.SplitHostPort(peer.endpoint)
-				if err != nil {
-					qn.logger.Fatalf("Failed to split host and port: %v", err)
-				}
-
-				err = RetryOperation(ctx, retryInterval, retries, func() error {
-					if conn, ok := qn.connections[host]; ok {
-						qn.logger.Infof("Connection already exists for peer endpoint %s", peer.endpoint)
-						c.SetConnection(conn)
-						return nil
-					}
-					qn.logger.Debugf("No existing connection to the peer endpoint %s.", peer.endpoint)
-
-					err := c.Dial(udpConn)
-					if err != nil {
-						qn.logger.Debugf("Failed to dial: %v", err)
-						qn.logger.Warnf("Retrying to dial %s", peer.endpoint)
-						return err
-					}
-					qn.logger.Infof("Dialed new connection to peer endpoint %s.", peer.endpoint)
-					c.AttachHandler(func(c packetContext) error {
-						msg := c.Data
-						qn.logger.Debugf("Client [ %s ] sent a message [ %v ] over server initiated connection", c.RemoteAddr().String(), msg)
-						c.localIf.Write(c.Data)
-						return nil
-					})
-					return nil
-				})
-				if err != nil {
-					qn.logger.Fatalf("Peer is not reachable or : %v", err)
-				}
-				qn.clients[peer.allowedIPs[0]] = c
-			}(peer)
+	//range over all peers and keep a connection to each of them
+	for _, peer := range qn.peers.all() {
+		if err := qn.startPeer(peer); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func (qn *QuicWire) enableTrafficForwarding() error {
-	go func() error {
-		// Start reading packets from the TUN interface
-		packet := make([]byte, 1500)
-		for {
-			n, err := qn.localIf.Read(packet)
-			if err != nil {
-				qn.logger.Fatalf("Failed to read packet from TUN interface: %v", err)
-				panic(err)
-			}
-
-			dstIP := net.IP(packet[16:20])
+// quicConfig returns the QUIC config of connections to the peers, sending a
+// keepalive after keepAlive of inactivity unless it is zero
+func (qn *QuicWire) quicConfig(keepAlive time.Duration) *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: qn.qc.nodeInterface.handshakeTimeout,
+		MaxIdleTimeout:       qn.qc.nodeInterface.idleTimeout,
+		KeepAlivePeriod:      keepAlive,
+		EnableDatagrams:      true,
+	}
+}
 
-			// Do something with the packet
-			qn.logger.Debugf("Received packet from local tun interface: %v for destination %s", packet[:n], dstIP.String())
+// handlePacket queues a packet received from a peer to be written to the
+// tunnel interface. Like WireGuard's cryptokey routing, the inner source
+// address must be routed to the sending peer, otherwise the packet is spoofed
+// and dropped.
+func (qn *QuicWire) handlePacket(c packetContext) error {
+	c.peer.stats.rxBytes.Add(uint64(len(c.Data)))
+	srcIP, ok := packetSource(c.Data)
+	if !ok {
+		qn.logger.Debugf("Dropping malformed packet from peer %s", c.peer.identity())
+		c.peer.stats.invalidPackets.Add(1)
+		qn.pool.put(c.buf)
+		return nil
+	}
+	if owner := qn.peers.lookup(srcIP); owner != c.peer {
+		qn.logger.Debugf("Dropping packet from peer %s with source %s outside of its AllowedIPs", c.peer.identity(), srcIP)
+		c.peer.stats.spoofedPackets.Add(1)
+		qn.pool.put(c.buf)
+		return nil
+	}
+	qn.writeDevice(c.Data, c.buf)
+	return nil
+}
 
-			//check if dstIp is in the list of peers
-			if c, ok := qn.clients[dstIP.String()]; ok {
-				err = c.SendBytes(packet[:n])
-				if err != nil {
-					qn.logger.Errorf("failed to send client message: %v", err)
-				}
-				//check if dstIp is in the Con
-			} else {
-				qn.logger.Debugf("No client connection found for destination IP %s", dstIP.String())
+// tunMTU returns the MTU of the tunnel interface, unless MTU is set. IPv6 needs
+// a larger MTU than fits in a single QUIC datagram, so it is only used when
+// IPv6 is tunneled.
+func (qn *QuicWire) tunMTU() int {
+	if qn.qc.nodeInterface.mtu != 0 {
+		return qn.qc.nodeInterface.mtu
+	}
+	for _, prefix := range qn.qc.nodeInterface.localEndpoint {
+		if prefix.Addr().Is6() {
+			return tunDevMTUIPv6
+		}
+	}
+	for _, peer := range qn.qc.peers {
+		for _, prefix := range peer.allowedIPs {
+			if prefix.Addr().Is6() {
+				return tunDevMTUIPv6
 			}
 		}
-	}()
-	return nil
+	}
+	return tunDevMTU
 }
@@ -0,0 +1,517 @@
+package quicwire
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+// testNode is a node running on the loopback interface with a MemoryDevice,
+// or with the userspace TCP/IP stack
+type testNode struct {
+	qw     *QuicWire
+	dev    *MemoryDevice
+	wg     sync.WaitGroup
+	key    PrivateKey
+	v4, v6 netip.Addr
+	port   int
+	// controlSocket is the path of the control socket, disabled when empty
+	controlSocket string
+	// netstack replaces the MemoryDevice with the userspace TCP/IP stack
+	netstack bool
+}
+
+// freePort returns a UDP port of the loopback interface that isn't in use
+func freePort(t testing.TB) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func newTestNode(t testing.TB, n byte) *testNode {
+	return &testNode{
+		key:  PrivateKey{n},
+		v4:   netip.AddrFrom4([4]byte{10, 99, 0, n}),
+		v6:   netip.MustParseAddr(fmt.Sprintf("fd99::%d", n)),
+		port: freePort(t),
+	}
+}
+
+// config returns the config of the node with the other nodes as its peers,
+// which it dials if dial is set
+func (n *testNode) config(dial bool, peers ...*testNode) Config {
+	conf := Config{Interface: InterfaceConfig{
+		LocalEndpoint: []string{n.v4.String() + "/24", n.v6.String() + "/64"},
+		LocalNodeIP:   "127.0.0.1",
+		ListenPort:    n.port,
+		PrivateKey:    n.key.String(),
+	}}
+	for _, p := range peers {
+		peer := PeerConfig{
+			PublicKey:  p.key.PublicKey().String(),
+			AllowedIPs: []string{p.v4.String(), p.v6.String()},
+		}
+		if dial {
+			peer.Endpoint = fmt.Sprintf("127.0.0.1:%d", p.port)
+		}
+		conf.Peers = append(conf.Peers, peer)
+	}
+	return conf
+}
+
+// start starts the node with the other nodes as its peers, which it dials if dial is set
+func (n *testNode) start(t testing.TB, dial bool, peers ...*testNode) {
+	t.Helper()
+	n.run(t, n.config(dial, peers...))
+}
+
+// run starts the node with conf
+func (n *testNode) run(t testing.TB, conf Config) {
+	t.Helper()
+	qw, err := NewQuicWire(testLogger(t), t.Name(), n.controlSocket, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qw.UseConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	if n.netstack {
+		qw.EnableNetstack()
+	} else {
+		n.dev = NewMemoryDevice("mem", tunDevMTUIPv6)
+		qw.UseDevice(n.dev)
+	}
+	qw.DisableSTUN()
+	n.qw = qw
+	t.Cleanup(func() {
+		qw.Stop()
+		n.wg.Wait()
+	})
+	if err := qw.Start(context.Background(), &n.wg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testLogger returns the logger of a node of the test. Benchmarks always print
+// their logs, so they only get the warnings and errors.
+func testLogger(t testing.TB) *zap.SugaredLogger {
+	if _, ok := t.(*testing.B); ok {
+		return zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel)).Sugar()
+	}
+	return zaptest.NewLogger(t).Sugar()
+}
+
+// waitFor polls cond until it is true or the test times out
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startPair starts two nodes that are peers of each other and waits until
+// they are connected. Only the first one dials, so no duplicate connection is
+// closed while packets are sent.
+func startPair(t testing.TB) (*testNode, *testNode) {
+	return startNodes(t, newTestNode(t, 1), newTestNode(t, 2))
+}
+
+// startNodes starts a pair of nodes like startPair
+func startNodes(t testing.TB, a, b *testNode) (*testNode, *testNode) {
+	b.start(t, false, a)
+	a.start(t, true, b)
+	waitFor(t, "the nodes to connect", func() bool {
+		return a.qw.Stats().ConnectedPeers == 1 && b.qw.Stats().ConnectedPeers == 1
+	})
+	return a, b
+}
+
+// udpPacket returns an IPv4 or IPv6 UDP packet from src to dst carrying size bytes.
+// Its checksums are left to zero, the nodes don't check them.
+func udpPacket(src, dst netip.Addr, size int) []byte {
+	var packet []byte
+	var udp []byte
+	if src.Is4() {
+		packet = make([]byte, 20+8+size)
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[8] = 64
+		packet[9] = 17
+		copy(packet[12:16], src.AsSlice())
+		copy(packet[16:20], dst.AsSlice())
+		udp = packet[20:]
+	} else {
+		packet = make([]byte, 40+8+size)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(8+size))
+		packet[6] = 17
+		packet[7] = 64
+		copy(packet[8:24], src.AsSlice())
+		copy(packet[24:40], dst.AsSlice())
+		udp = packet[40:]
+	}
+	binary.BigEndian.PutUint16(udp[0:], 40000)
+	binary.BigEndian.PutUint16(udp[2:], 9)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+size))
+	for i := 8; i < len(udp); i++ {
+		udp[i] = byte(i)
+	}
+	return packet
+}
+
+// expectPacket waits for packet to be written to the device of n
+func expectPacket(t *testing.T, n *testNode, packet []byte) {
+	t.Helper()
+	select {
+	case got := <-n.dev.Outbound():
+		if !bytes.Equal(got, packet) {
+			t.Fatalf("got packet of %d bytes, want %d bytes", len(got), len(packet))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("packet of %d bytes not delivered", len(packet))
+	}
+}
+
+// expectNoPacket checks that nothing is written to the device of n
+func expectNoPacket(t *testing.T, n *testNode) {
+	t.Helper()
+	select {
+	case got := <-n.dev.Outbound():
+		t.Fatalf("unexpected packet of %d bytes delivered", len(got))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	a, b := startPair(t)
+	tests := []struct {
+		name     string
+		from, to *testNode
+		ipv6     bool
+		size     int
+	}{
+		{"ipv4 a to b", a, b, false, 100},
+		{"ipv4 b to a", b, a, false, 1000},
+		{"ipv6 a to b", a, b, true, 100},
+		{"ipv6 b to a", b, a, true, 500},
+		// Larger than a datagram, so carried in fragments
+		{"fragmented ipv6 a to b", a, b, true, 1280 - 48},
+		{"fragmented ipv6 b to a", b, a, true, 1280 - 48},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tt.from.v4, tt.to.v4
+			if tt.ipv6 {
+				src, dst = tt.from.v6, tt.to.v6
+			}
+			packet := udpPacket(src, dst, tt.size)
+			if err := tt.from.dev.Inject(packet); err != nil {
+				t.Fatal(err)
+			}
+			expectPacket(t, tt.to, packet)
+		})
+	}
+	if stats := b.qw.Stats(); stats.SpoofedPackets != 0 || stats.InvalidPackets != 0 || stats.DroppedPackets != 0 {
+		t.Errorf("unexpected drops %+v", stats)
+	}
+}
+
+func TestSpoofedSource(t *testing.T) {
+	a, b := startPair(t)
+
+	// a forwards by destination, b drops the packets whose source isn't in the AllowedIPs of a
+	for _, src := range []netip.Addr{netip.MustParseAddr("10.99.0.7"), b.v4} {
+		if err := a.dev.Inject(udpPacket(src, b.v4, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.dev.Inject(udpPacket(netip.MustParseAddr("fd99::7"), b.v6, 100)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the spoofed packets to be dropped", func() bool {
+		return b.qw.Stats().SpoofedPackets == 3
+	})
+	expectNoPacket(t, b)
+
+	// Packets of the peer still get through
+	packet := udpPacket(a.v4, b.v4, 100)
+	if err := a.dev.Inject(packet); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, b, packet)
+}
+
+func TestTruncatedPacket(t *testing.T) {
+	a, b := startPair(t)
+
+	// Read truncated to the buffer, which holds a packet of the MTU
+	tooLarge := udpPacket(a.v6, b.v6, tunDevMTUIPv6)
+	// Shorter than its IP header says, as when the device truncates it to the MTU
+	short := udpPacket(a.v4, b.v4, 100)
+	binary.BigEndian.PutUint16(short[2:], uint16(len(short)+1))
+	for _, packet := range [][]byte{tooLarge, short} {
+		if err := a.dev.Inject(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectNoPacket(t, b)
+
+	// A packet of the MTU fits
+	packet := udpPacket(a.v6, b.v6, tunDevMTUIPv6-48)
+	if err := a.dev.Inject(packet); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, b, packet)
+}
+
+func TestRemovePeer(t *testing.T) {
+	a, b := startPair(t)
+	identity := b.key.PublicKey().String()
+	if err := a.qw.SetPeer(PeerUpdate{Identity: identity, Remove: true}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := a.qw.Stats(); stats.Peers != 0 {
+		t.Fatalf("%d peers left after removal", stats.Peers)
+	}
+	// b loses its connection and can't connect again, a no longer knows its key
+	waitFor(t, "b to lose its connection", func() bool {
+		return b.qw.Stats().ConnectedPeers == 0
+	})
+
+	// Packets to the removed peer aren't routed anymore
+	if err := a.dev.Inject(udpPacket(a.v4, b.v4, 100)); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPacket(t, b)
+	if err := a.qw.SetPeer(PeerUpdate{Identity: identity, Remove: true}); err == nil {
+		t.Fatalf("removing the peer twice succeeded")
+	}
+}
+
+// TestStartConcurrently reads the node from other goroutines while it starts
+// and stops, which the race detector checks
+func TestStartConcurrently(t *testing.T) {
+	a, b := newTestNode(t, 1), newTestNode(t, 2)
+	qw, err := NewQuicWire(testLogger(t), t.Name(), "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qw.UseConfig(a.config(true, b)); err != nil {
+		t.Fatal(err)
+	}
+	qw.UseDevice(NewMemoryDevice("mem", tunDevMTUIPv6))
+	qw.DisableSTUN()
+	done := qw.Done()
+	if done == nil {
+		t.Fatalf("Done is nil before Start")
+	}
+
+	var wg sync.WaitGroup
+	started := make(chan error, 1)
+	go func() {
+		started <- qw.Start(context.Background(), &wg)
+	}()
+	var startErr error
+	for running := true; running; {
+		select {
+		case startErr = <-started:
+			running = false
+		default:
+		}
+		if status := qw.Status(); status.Name != "" && status.ListenPort != a.port {
+			t.Errorf("status %+v of a running node has the wrong port", status)
+		}
+		_ = qw.Netstack()
+		_ = qw.AddPeer(PeerConfig{})
+	}
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+	if status := qw.Status(); status.Name != "mem" || status.ListenPort != a.port {
+		t.Errorf("got status %+v", status)
+	}
+
+	go qw.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Done not closed by Stop")
+	}
+	wg.Wait()
+	if err := qw.Start(context.Background(), &wg); err == nil {
+		t.Fatalf("stopped node started again")
+	}
+}
+
+func TestStartWhileRunning(t *testing.T) {
+	dir := t.TempDir()
+	running := newTestNode(t, 1)
+	running.controlSocket = filepath.Join(dir, "quicwire.sock")
+	running.start(t, false)
+
+	tests := []struct {
+		name          string
+		port          int
+		controlSocket string
+	}{
+		{"same port", running.port, ""},
+		{"same control socket", freePort(t), running.controlSocket},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The hooks of the second node must not run, they would undo
+			// those of the running one
+			marker := filepath.Join(dir, fmt.Sprintf("hook%d", i))
+			conf := running.config(false)
+			conf.Interface.ListenPort = tt.port
+			conf.Interface.PreUp = []string{"touch " + marker}
+			conf.Interface.PostDown = []string{"touch " + marker}
+			qw, err := NewQuicWire(testLogger(t), t.Name(), tt.controlSocket, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := qw.UseConfig(conf); err != nil {
+				t.Fatal(err)
+			}
+			qw.UseDevice(NewMemoryDevice("mem", tunDevMTUIPv6))
+			qw.DisableSTUN()
+			var wg sync.WaitGroup
+			err = qw.Start(context.Background(), &wg)
+			qw.Stop()
+			wg.Wait()
+			if err == nil {
+				t.Fatalf("second node started")
+			}
+			if _, err := os.Stat(marker); err == nil {
+				t.Fatalf("hooks of the second node ran")
+			}
+			if _, err := ControlShow(running.controlSocket); err != nil {
+				t.Fatalf("running node no longer answers: %v", err)
+			}
+		})
+	}
+}
+
+// relay forwards the datagrams between a client and a server like a NAT,
+// sending those of the client to the server from its current outgoing socket
+type relay struct {
+	t      *testing.T
+	in     *net.UDPConn
+	server *net.UDPAddr
+	mu     sync.Mutex
+	out    *net.UDPConn
+	client *net.UDPAddr
+}
+
+func newRelay(t *testing.T, server *net.UDPAddr) *relay {
+	in, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &relay{t: t, in: in, server: server}
+	r.rebind()
+	t.Cleanup(func() {
+		in.Close()
+		r.mu.Lock()
+		r.out.Close()
+		r.mu.Unlock()
+	})
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, client, err := in.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.client = client
+			out := r.out
+			r.mu.Unlock()
+			_, _ = out.WriteToUDP(buf[:n], server)
+		}
+	}()
+	return r
+}
+
+// rebind replaces the outgoing socket, so the server receives the datagrams
+// of the client from a new address. It returns that address.
+func (r *relay) rebind() string {
+	out, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.mu.Lock()
+	old := r.out
+	r.out = out
+	r.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := out.Read(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			client := r.client
+			r.mu.Unlock()
+			_, _ = r.in.WriteToUDP(buf[:n], client)
+		}
+	}()
+	return out.LocalAddr().String()
+}
+
+func TestRoaming(t *testing.T) {
+	a, b := newTestNode(t, 1), newTestNode(t, 2)
+	b.start(t, false, a)
+	r := newRelay(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: b.port})
+	conf := a.config(true, b)
+	conf.Peers[0].Endpoint = r.in.LocalAddr().String()
+	a.run(t, conf)
+	waitFor(t, "the nodes to connect", func() bool {
+		return a.qw.Stats().ConnectedPeers == 1 && b.qw.Stats().ConnectedPeers == 1
+	})
+	before := b.qw.Status().Peers[0]
+
+	// a moves to another address, b migrates the connection to it
+	endpoint := r.rebind()
+	packet := udpPacket(a.v4, b.v4, 100)
+	if err := a.dev.Inject(packet); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, b, packet)
+	waitFor(t, "b to learn the new endpoint", func() bool {
+		return b.qw.Status().Peers[0].LearnedEndpoint == endpoint
+	})
+	after := b.qw.Status().Peers[0]
+	if !after.LastHandshake.Equal(before.LastHandshake) {
+		t.Fatalf("connection was replaced when the peer roamed")
+	}
+
+	packet = udpPacket(b.v4, a.v4, 100)
+	if err := b.dev.Inject(packet); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, a, packet)
+}
@@ -0,0 +1,277 @@
+package quicwire
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errNoConnection is returned when sending to a peer that isn't connected
+var errNoConnection = errors.New("no connection to peer")
+
+// peerState holds the runtime state of a peer. The configuration is replaced
+// as a whole when the peer is updated, the connection is swapped atomically.
+type peerState struct {
+	// id is the identity of the peer, it never changes
+	id   string
+	conf atomic.Pointer[Peer]
+	// ctx is cancelled when the peer is removed or the node stops
+	ctx    context.Context
+	cancel context.CancelFunc
+	stats  peerStats
+	// clientMu serializes the replacement of the connection
+	clientMu sync.Mutex
+	client   atomic.Pointer[Client]
+	// state holds the peerConnState of the connection
+	state atomic.Int32
+	// changed wakes up the supervisor when the connection or the configuration is replaced
+	changed chan struct{}
+	// tlsConf is used to dial the peer
+	tlsConf *tls.Config
+	// learnedEndpoint is the address of the latest connection with the peer
+	learnedEndpoint atomic.Pointer[string]
+	// lastErr is the latest failure of the peer
+	lastErr atomic.Pointer[peerError]
+	// queue holds the packets read from the device for the peer, sent by its sender
+	queue chan *packetBuf
+}
+
+// peerError is a failure of a peer, which doesn't affect the other peers
+type peerError struct {
+	err  error
+	time time.Time
+}
+
+// setError records the latest failure of the peer, shown in its status
+func (p *peerState) setError(err error) {
+	p.lastErr.Store(&peerError{err: err, time: time.Now()})
+}
+
+func newPeerState(ctx context.Context, peer Peer) *peerState {
+	p := &peerState{
+		id:      peer.identity(),
+		changed: make(chan struct{}, 1),
+		queue:   make(chan *packetBuf, peerQueueLen),
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.conf.Store(&peer)
+	return p
+}
+
+// identity returns the identity of the peer
+func (p *peerState) identity() string {
+	return p.id
+}
+
+// config returns the current configuration of the peer
+func (p *peerState) config() *Peer {
+	return p.conf.Load()
+}
+
+// wake wakes up the supervisor of the peer
+func (p *peerState) wake() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue queues a packet for the sender of the peer and reports whether the
+// sender took the buffer. The packet is dropped while the peer isn't
+// connected or its queue is full.
+func (p *peerState) enqueue(b *packetBuf) bool {
+	if p.client.Load() == nil {
+		p.stats.droppedPackets.Add(1)
+		return false
+	}
+	select {
+	case p.queue <- b:
+		return true
+	default:
+		p.stats.droppedPackets.Add(1)
+		return false
+	}
+}
+
+// send sends a packet to the peer over its current connection. It is only
+// called by the sender of the peer.
+func (p *peerState) send(packet []byte) error {
+	c := p.client.Load()
+	if c == nil {
+		return fmt.Errorf("%w %s", errNoConnection, p.identity())
+	}
+	if err := c.SendBytes(packet); err != nil {
+		return err
+	}
+	p.stats.txBytes.Add(uint64(len(packet)))
+	return nil
+}
+
+// registryState is an immutable view of the peers and their routes. It is
+// never modified once published, changes publish a new copy.
+type registryState struct {
+	peers  map[string]*peerState
+	routes *routeTable
+}
+
+// peerRegistry holds the peers of the node. Lookups on the packet path read
+// the current state without locking, while changes are serialized, copy the
+// state and publish the copy atomically.
+type peerRegistry struct {
+	mu    sync.Mutex
+	state atomic.Pointer[registryState]
+}
+
+func newPeerRegistry() *peerRegistry {
+	r := &peerRegistry{}
+	r.state.Store(&registryState{
+		peers:  make(map[string]*peerState),
+		routes: newRouteTable(),
+	})
+	return r
+}
+
+// get returns the peer with the given identity, or nil
+func (r *peerRegistry) get(identity string) *peerState {
+	return r.state.Load().peers[identity]
+}
+
+// lookup returns the peer owning the longest AllowedIPs prefix that contains addr, or nil
+func (r *peerRegistry) lookup(addr netip.Addr) *peerState {
+	state := r.state.Load()
+	identity, ok := state.routes.lookup(addr)
+	if !ok {
+		return nil
+	}
+	return state.peers[identity]
+}
+
+// all returns every peer, ordered by identity
+func (r *peerRegistry) all() []*peerState {
+	state := r.state.Load()
+	peers := make([]*peerState, 0, len(state.peers))
+	for _, p := range state.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].identity() < peers[j].identity()
+	})
+	return peers
+}
+
+// add registers a new peer and routes its AllowedIPs to it
+func (r *peerRegistry) add(p *peerState) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.state.Load()
+	if _, ok := old.peers[p.identity()]; ok {
+		return fmt.Errorf("peer %s already exists", p.identity())
+	}
+	if err := old.checkAllowedIPs(p.identity(), p.config().allowedIPs); err != nil {
+		return err
+	}
+	peers := make(map[string]*peerState, len(old.peers)+1)
+	for id, existing := range old.peers {
+		peers[id] = existing
+	}
+	peers[p.identity()] = p
+	r.publish(peers)
+	return nil
+}
+
+// update replaces the configuration of a registered peer and reroutes its AllowedIPs
+func (r *peerRegistry) update(peer Peer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.state.Load()
+	p, ok := old.peers[peer.identity()]
+	if !ok {
+		return fmt.Errorf("peer %s not found", peer.identity())
+	}
+	if err := old.checkAllowedIPs(p.identity(), peer.allowedIPs); err != nil {
+		return err
+	}
+	p.conf.Store(&peer)
+	r.publish(old.peers)
+	return nil
+}
+
+// remove unregisters the peer and its routes, and returns its state or nil
+func (r *peerRegistry) remove(identity string) *peerState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.state.Load()
+	p, ok := old.peers[identity]
+	if !ok {
+		return nil
+	}
+	peers := make(map[string]*peerState, len(old.peers))
+	for id, existing := range old.peers {
+		if id != identity {
+			peers[id] = existing
+		}
+	}
+	r.publish(peers)
+	return p
+}
+
+// sync makes the registered peers match configs and publishes the result at
+// once, so prefixes can move between peers. New peers are created with
+// newState, and the peers whose configuration changed are returned in updated.
+func (r *peerRegistry) sync(configs []Peer, newState func(Peer) *peerState) (added, updated, removed []*peerState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.state.Load()
+	peers := make(map[string]*peerState, len(configs))
+	for _, peer := range configs {
+		peer := peer
+		p, ok := old.peers[peer.identity()]
+		switch {
+		case !ok:
+			p = newState(peer)
+			added = append(added, p)
+		case !p.config().equal(&peer):
+			p.conf.Store(&peer)
+			updated = append(updated, p)
+		}
+		peers[peer.identity()] = p
+	}
+	for id, p := range old.peers {
+		if _, ok := peers[id]; !ok {
+			removed = append(removed, p)
+		}
+	}
+	r.publish(peers)
+	return added, updated, removed
+}
+
+// checkAllowedIPs reports an error if another peer already owns one of the prefixes
+func (s *registryState) checkAllowedIPs(identity string, prefixes []netip.Prefix) error {
+	for _, prefix := range prefixes {
+		if owner, ok := s.routes.get(prefix); ok && owner != identity {
+			return fmt.Errorf("AllowedIPs %s is already assigned to peer %s", prefix, owner)
+		}
+	}
+	return nil
+}
+
+// publish rebuilds the routes for peers and makes the new state visible. It
+// must be called with mu held.
+func (r *peerRegistry) publish(peers map[string]*peerState) {
+	routes := newRouteTable()
+	for _, p := range peers {
+		for _, prefix := range p.config().allowedIPs {
+			routes.insert(prefix, p.identity())
+		}
+	}
+	r.state.Store(&registryState{
+		peers:  peers,
+		routes: routes,
+	})
+}
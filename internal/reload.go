@@ -0,0 +1,112 @@
+package quicwire
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// Reload reads the config file again and applies the changes of the peers.
+// Only the peers that were added, removed or changed are affected, the
+// connections to the other peers are kept. An invalid config is rejected and
+// the running configuration is left unchanged. Changes of the interface
+// section need a restart and are ignored.
+func (qn *QuicWire) Reload() error {
+	qc := &QuicConf{}
+	if err := qn.readConfig(qc); err != nil {
+		return fmt.Errorf("rejected config %s: %w", qn.configFile, err)
+	}
+
+	qn.setMu.Lock()
+	defer qn.setMu.Unlock()
+	if !qn.isRunning() {
+		return fmt.Errorf("node is not running")
+	}
+	for _, warning := range qc.warnings {
+		qn.logger.Warnf("%s: %s", qn.configFile, warning)
+	}
+	if !qn.qc.nodeInterface.equal(&qc.nodeInterface) {
+		qn.logger.Warnf("Changes of the [Interface] section in %s are only applied on restart", qn.configFile)
+	}
+	for _, o := range qc.allowedIPOverlaps() {
+		qn.logger.Warnf("AllowedIPs %s of peer %s overlaps %s of peer %s, the longest prefix wins",
+			o.prefix, o.peer, o.otherPrefix, o.otherPeer)
+	}
+
+	old := make(map[string]*Peer)
+	for _, p := range qn.peers.all() {
+		old[p.identity()] = p.config()
+	}
+	added, updated, removed := qn.peers.sync(qc.peers, func(peer Peer) *peerState {
+		return newPeerState(qn.ctx, peer)
+	})
+	qn.qc.peers = qc.peers
+
+	// Routes are removed before they are installed, so prefixes can move between peers
+	var errs []error
+	// A peer that fails is reported and the others are still applied
+	for _, p := range removed {
+		errs = append(errs, qn.stopPeer(p))
+		qn.logger.Infof("Removed peer %s", p.identity())
+		qn.emit(Event{Type: EventPeerRemoved, Peer: p.identity()})
+	}
+	for _, p := range updated {
+		if err := qn.peerChanged(p, old[p.identity()]); err != nil {
+			qn.reportPeerError(p, err)
+			errs = append(errs, err)
+		}
+		qn.logger.Infof("Updated peer %s", p.identity())
+		qn.emit(Event{Type: EventPeerUpdated, Peer: p.identity()})
+	}
+	for _, p := range added {
+		if err := qn.activatePeer(p); err != nil {
+			qn.reportPeerError(p, err)
+			errs = append(errs, err)
+		}
+		qn.logger.Infof("Added peer %s", p.identity())
+		qn.emit(Event{Type: EventPeerAdded, Peer: p.identity()})
+	}
+	qn.logger.Infof("Reloaded %s: %d peers added, %d updated, %d removed", qn.configFile, len(added), len(updated), len(removed))
+	return errors.Join(errs...)
+}
+
+// WatchConfig reloads the config file whenever it is modified, until the node
+// stops. The file is polled, so it also works for files that are replaced
+// rather than written in place.
+func (qn *QuicWire) WatchConfig() {
+	modTime := func() time.Time {
+		info, err := os.Stat(qn.configFile)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	last := modTime()
+
+	qn.wg.Add(1)
+	go func() {
+		defer qn.wg.Done()
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-qn.ctx.Done():
+				return
+			}
+			current := modTime()
+			if current.IsZero() || current.Equal(last) {
+				continue
+			}
+			last = current
+			qn.logger.Infof("Config file %s changed, reloading", qn.configFile)
+			if err := qn.Reload(); err != nil {
+				qn.logger.Errorf("Failed to reload config: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,35 @@
+//go:build darwin
+
+package quicwire
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+)
+
+// addRoute routes the prefix through the tunnel interface
+func addRoute(ifName string, prefix netip.Prefix, table int) error {
+	if table != routeTableAuto {
+		return fmt.Errorf("routing tables are not supported on darwin")
+	}
+	if out, err := exec.Command("route", "-q", "-n", "add", routeFamily(prefix), prefix.String(), "-interface", ifName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add route %s: %w: %s", prefix, err, out)
+	}
+	return nil
+}
+
+// delRoute removes a route added by addRoute
+func delRoute(ifName string, prefix netip.Prefix, table int) error {
+	if out, err := exec.Command("route", "-q", "-n", "delete", routeFamily(prefix), prefix.String(), "-interface", ifName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove route %s: %w: %s", prefix, err, out)
+	}
+	return nil
+}
+
+func routeFamily(prefix netip.Prefix) string {
+	if prefix.Addr().Is4() {
+		return "-inet"
+	}
+	return "-inet6"
+}
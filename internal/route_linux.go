@@ -0,0 +1,58 @@
+//go:build linux
+
+package quicwire
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+)
+
+// addRoute routes the prefix through the tunnel interface in the given table
+func addRoute(ifName string, prefix netip.Prefix, table int) error {
+	route, err := tunRoute(ifName, prefix, table)
+	if err != nil {
+		return &LinkError{Op: "add route", Link: ifName, Arg: prefix.String(), Err: err}
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return &LinkError{Op: "add route", Link: ifName, Arg: prefix.String(), Err: err}
+	}
+	return nil
+}
+
+// delRoute removes a route added by addRoute
+func delRoute(ifName string, prefix netip.Prefix, table int) error {
+	route, err := tunRoute(ifName, prefix, table)
+	if err != nil {
+		return &LinkError{Op: "remove route", Link: ifName, Arg: prefix.String(), Err: err}
+	}
+	if err := netlink.RouteDel(route); err != nil {
+		return &LinkError{Op: "remove route", Link: ifName, Arg: prefix.String(), Err: err}
+	}
+	return nil
+}
+
+func tunRoute(ifName string, prefix netip.Prefix, table int) (*netlink.Route, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, err
+	}
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       prefixToIPNet(prefix),
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if table != routeTableAuto {
+		route.Table = table
+	}
+	return route, nil
+}
+
+// prefixToIPNet converts the prefix, keeping the host bits of the address
+func prefixToIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
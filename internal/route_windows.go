@@ -0,0 +1,37 @@
+//go:build windows
+
+package quicwire
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+)
+
+// addRoute routes the prefix through the tunnel interface
+func addRoute(ifName string, prefix netip.Prefix, table int) error {
+	if table != routeTableAuto {
+		return fmt.Errorf("routing tables are not supported on windows")
+	}
+	cmd := exec.Command("netsh", "interface", routeFamily(prefix), "add", "route", prefix.String(), ifName, "store=active")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add route %s: %w: %s", prefix, err, out)
+	}
+	return nil
+}
+
+// delRoute removes a route added by addRoute
+func delRoute(ifName string, prefix netip.Prefix, table int) error {
+	cmd := exec.Command("netsh", "interface", routeFamily(prefix), "delete", "route", prefix.String(), ifName, "store=active")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove route %s: %w: %s", prefix, err, out)
+	}
+	return nil
+}
+
+func routeFamily(prefix netip.Prefix) string {
+	if prefix.Addr().Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
@@ -0,0 +1,112 @@
+package quicwire
+
+import (
+	"net/netip"
+)
+
+// routeTable maps AllowedIPs prefixes to the identity of the peer that owns
+// them. Lookups return the longest prefix that contains the address.
+type routeTable struct {
+	v4 *routeNode
+	v6 *routeNode
+}
+
+// routeNode is a node in a binary trie keyed by the bits of the prefix
+type routeNode struct {
+	child  [2]*routeNode
+	prefix netip.Prefix
+	peer   string
+	set    bool
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		v4: &routeNode{},
+		v6: &routeNode{},
+	}
+}
+
+func (t *routeTable) root(addr netip.Addr) *routeNode {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+// bitAt returns the bit of addr at position i, counting from the most
+// significant bit. It doesn't allocate, lookups run for every packet.
+func bitAt(addr netip.Addr, i int) int {
+	if addr.Is4() {
+		b := addr.As4()
+		return int(b[i/8]>>(7-uint(i%8))) & 1
+	}
+	b := addr.As16()
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+// insert adds the prefix to the table, replacing the owner of an existing entry
+func (t *routeTable) insert(prefix netip.Prefix, peer string) {
+	prefix = prefix.Masked()
+	node := t.root(prefix.Addr())
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := bitAt(prefix.Addr(), i)
+		if node.child[bit] == nil {
+			node.child[bit] = &routeNode{}
+		}
+		node = node.child[bit]
+	}
+	node.prefix = prefix
+	node.peer = peer
+	node.set = true
+}
+
+// find returns the node of the prefix, or nil
+func (t *routeTable) find(prefix netip.Prefix) *routeNode {
+	prefix = prefix.Masked()
+	node := t.root(prefix.Addr())
+	for i := 0; i < prefix.Bits() && node != nil; i++ {
+		node = node.child[bitAt(prefix.Addr(), i)]
+	}
+	if node == nil || !node.set {
+		return nil
+	}
+	return node
+}
+
+// get returns the peer owning exactly the prefix
+func (t *routeTable) get(prefix netip.Prefix) (string, bool) {
+	node := t.find(prefix)
+	if node == nil {
+		return "", false
+	}
+	return node.peer, true
+}
+
+// remove deletes the prefix from the table and reports whether it was present
+func (t *routeTable) remove(prefix netip.Prefix) bool {
+	node := t.find(prefix)
+	if node == nil {
+		return false
+	}
+	node.peer = ""
+	node.set = false
+	return true
+}
+
+// lookup returns the peer owning the longest prefix that contains addr
+func (t *routeTable) lookup(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	node := t.root(addr)
+	var peer string
+	var found bool
+	for i := 0; node != nil; i++ {
+		if node.set {
+			peer, found = node.peer, true
+		}
+		if i == addr.BitLen() {
+			break
+		}
+		node = node.child[bitAt(addr, i)]
+	}
+	return peer, found
+}
@@ -0,0 +1,144 @@
+package quicwire
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// testRoutes returns a table holding the routes, mapped to their peer
+func testRoutes(routes map[string]string) *routeTable {
+	t := newRouteTable()
+	for prefix, peer := range routes {
+		t.insert(netip.MustParsePrefix(prefix), peer)
+	}
+	return t
+}
+
+func TestRouteLookup(t *testing.T) {
+	routes := testRoutes(map[string]string{
+		"0.0.0.0/0":     "default4",
+		"10.0.0.0/8":    "a",
+		"10.1.0.0/16":   "b",
+		"10.1.2.0/24":   "c",
+		"10.1.2.3/32":   "d",
+		"fd00::/8":      "e",
+		"fd00:1::/32":   "f",
+		"fd00:1::1/128": "g",
+	})
+	tests := []struct {
+		name  string
+		addr  string
+		peer  string
+		found bool
+	}{
+		{"host route", "10.1.2.3", "d", true},
+		{"next to host route", "10.1.2.4", "c", true},
+		{"/16", "10.1.3.1", "b", true},
+		{"/8", "10.2.0.1", "a", true},
+		{"default route", "192.0.2.1", "default4", true},
+		{"first address", "0.0.0.0", "default4", true},
+		{"last address", "255.255.255.255", "default4", true},
+		{"ipv4-mapped ipv6", "::ffff:10.1.2.3", "d", true},
+		{"ipv6 host route", "fd00:1::1", "g", true},
+		{"ipv6 /32", "fd00:1::2", "f", true},
+		{"ipv6 /8", "fd00:2::1", "e", true},
+		// The IPv4 default route doesn't cover IPv6
+		{"ipv6 outside of the routes", "2001:db8::1", "", false},
+		{"ipv6 unspecified", "::", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer, found := routes.lookup(netip.MustParseAddr(tt.addr))
+			if peer != tt.peer || found != tt.found {
+				t.Fatalf("lookup(%s) = %q, %v, want %q, %v", tt.addr, peer, found, tt.peer, tt.found)
+			}
+		})
+	}
+}
+
+func TestRouteRoots(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes map[string]string
+		addr   string
+		peer   string
+		found  bool
+	}{
+		{"ipv6 default route", map[string]string{"::/0": "a"}, "2001:db8::1", "a", true},
+		{"ipv6 default route with ipv4", map[string]string{"::/0": "a"}, "192.0.2.1", "", false},
+		{"ipv4 default route with ipv6", map[string]string{"0.0.0.0/0": "a"}, "::1", "", false},
+		{"both default routes, ipv4", map[string]string{"0.0.0.0/0": "a", "::/0": "b"}, "192.0.2.1", "a", true},
+		{"both default routes, ipv6", map[string]string{"0.0.0.0/0": "a", "::/0": "b"}, "2001:db8::1", "b", true},
+		// Same leading bits in both families
+		{"ipv4 prefix with ipv6", map[string]string{"32.0.0.0/8": "a"}, "2000::1", "", false},
+		{"ipv6 prefix with ipv4", map[string]string{"2000::/8": "a"}, "32.0.0.1", "", false},
+		{"empty table", nil, "192.0.2.1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer, found := testRoutes(tt.routes).lookup(netip.MustParseAddr(tt.addr))
+			if peer != tt.peer || found != tt.found {
+				t.Fatalf("lookup(%s) = %q, %v, want %q, %v", tt.addr, peer, found, tt.peer, tt.found)
+			}
+		})
+	}
+}
+
+func TestRouteInsertRemove(t *testing.T) {
+	type step struct {
+		// insert the prefix for peer, or remove it when peer is empty
+		prefix string
+		peer   string
+		// removed is the result of a removal
+		removed bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		addr  string
+		peer  string
+		found bool
+	}{
+		{"insert", []step{{"10.0.0.0/8", "a", false}}, "10.1.1.1", "a", true},
+		{"insert unmasked prefix", []step{{"10.1.2.3/8", "a", false}}, "10.200.0.1", "a", true},
+		{"replace owner", []step{{"10.0.0.0/8", "a", false}, {"10.0.0.0/8", "b", false}}, "10.1.1.1", "b", true},
+		{"remove", []step{{"10.0.0.0/8", "a", false}, {"10.0.0.0/8", "", true}}, "10.1.1.1", "", false},
+		{"remove unmasked prefix", []step{{"10.0.0.0/8", "a", false}, {"10.9.9.9/8", "", true}}, "10.1.1.1", "", false},
+		{"remove missing prefix", []step{{"10.0.0.0/8", "a", false}, {"192.168.0.0/16", "", false}}, "10.1.1.1", "a", true},
+		{"remove twice", []step{{"10.0.0.0/8", "a", false}, {"10.0.0.0/8", "", true}, {"10.0.0.0/8", "", false}}, "10.1.1.1", "", false},
+		// 10.1.0.0/16 is only a node on the path to the /24
+		{"remove intermediate node", []step{{"10.1.2.0/24", "a", false}, {"10.1.0.0/16", "", false}}, "10.1.2.1", "a", true},
+		{"remove longer prefix", []step{{"10.0.0.0/8", "a", false}, {"10.1.0.0/16", "b", false}, {"10.1.0.0/16", "", true}}, "10.1.1.1", "a", true},
+		{"remove shorter prefix", []step{{"10.0.0.0/8", "a", false}, {"10.1.0.0/16", "b", false}, {"10.0.0.0/8", "", true}}, "10.1.1.1", "b", true},
+		{"shorter prefix after removal", []step{{"10.0.0.0/8", "a", false}, {"10.1.0.0/16", "b", false}, {"10.0.0.0/8", "", true}}, "10.2.1.1", "", false},
+		{"remove default route", []step{{"0.0.0.0/0", "a", false}, {"10.0.0.0/8", "b", false}, {"0.0.0.0/0", "", true}}, "192.0.2.1", "", false},
+		{"remove ipv6 default route", []step{{"::/0", "a", false}, {"0.0.0.0/0", "b", false}, {"::/0", "", true}}, "192.0.2.1", "b", true},
+		{"ipv4 removal keeps ipv6", []step{{"0.0.0.0/0", "a", false}, {"::/0", "b", false}, {"0.0.0.0/0", "", true}}, "2001:db8::1", "b", true},
+		{"remove ipv6 host route", []step{{"fd00::/64", "a", false}, {"fd00::1/128", "b", false}, {"fd00::1/128", "", true}}, "fd00::1", "a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := newRouteTable()
+			for i, s := range tt.steps {
+				prefix := netip.MustParsePrefix(s.prefix)
+				if s.peer != "" {
+					routes.insert(prefix, s.peer)
+					if peer, ok := routes.get(prefix); !ok || peer != s.peer {
+						t.Fatalf("step %d: get(%s) = %q, %v after inserting it", i, prefix, peer, ok)
+					}
+					continue
+				}
+				if removed := routes.remove(prefix); removed != s.removed {
+					t.Fatalf("step %d: remove(%s) = %v, want %v", i, prefix, removed, s.removed)
+				}
+				if _, ok := routes.get(prefix); ok {
+					t.Fatalf("step %d: %s still present after removing it", i, prefix)
+				}
+			}
+			peer, found := routes.lookup(netip.MustParseAddr(tt.addr))
+			if peer != tt.peer || found != tt.found {
+				t.Fatalf("lookup(%s) = %q, %v, want %q, %v", tt.addr, peer, found, tt.peer, tt.found)
+			}
+		})
+	}
+}
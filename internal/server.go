@@ -2,29 +2,30 @@ package quicwire
 
 import (
 	"context"
-	"fmt"
-	"net"
+	"crypto/tls"
 	"sync"
 
 	"github.com/quic-go/quic-go"
-	"github.com/songgao/water"
 	"go.uber.org/zap"
 )
 
 // Server struct holds state related to the server instance and its connections
 type Server struct {
-	addr            string
-	tunnelInterface *water.Interface
-	handler         Handler
-	logger          *zap.SugaredLogger
+	addr     string
+	handler  Handler
+	tlsConf  *tls.Config
+	quicConf *quic.Config
+	listener *quic.Listener
+	logger   *zap.SugaredLogger
 }
 
 // NewServer creates a new server that listen on given port for incoming QUIC connections
-func NewServer(addr string, tunIface *water.Interface, logger *zap.SugaredLogger) *Server {
+func NewServer(addr string, tlsConf *tls.Config, quicConf *quic.Config, logger *zap.SugaredLogger) *Server {
 	return &Server{
-		addr:            addr,
-		tunnelInterface: tunIface,
-		logger:          logger,
+		addr:     addr,
+		tlsConf:  tlsConf,
+		quicConf: quicConf,
+		logger:   logger,
 	}
 }
 
@@ -33,46 +34,51 @@ func (s *Server) SetHandler(handler Handler) {
 	s.handler = handler
 }
 
-// StartServer starts the server and listens for incoming connections
-// StartServer starts the server and listens for incoming connections
-func (s *Server) StartServer(ctx context.Context, udpConn *net.UDPConn, qm *QuicWire, wg *sync.WaitGroup) error {
-	listener, err := quic.Listen(udpConn, getTLSConfig(), &quic.Config{
-		KeepAlivePeriod: 10,
-		EnableDatagrams: true,
-	})
+// Listen creates the QUIC listener on the transport of the shared UDP socket
+func (s *Server) Listen(tr *quic.Transport) error {
+	listener, err := tr.Listen(s.tlsConf, s.quicConf)
 	if err != nil {
 		return err
 	}
+	s.listener = listener
+	return nil
+}
 
-	wg.Done()
+// StartServer accepts incoming connections until ctx is cancelled
+func (s *Server) StartServer(ctx context.Context, qm *QuicWire, wg *sync.WaitGroup) error {
+	defer s.listener.Close()
 
 	for {
-		conn, _ := listener.Accept(ctx)
-		s.logger.Infof("Accepted connection from %v and local address is %v", conn.RemoteAddr(), conn.LocalAddr())
-		//split host and port
-		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		conn, err := s.listener.Accept(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
-
-		qm.connections[host] = conn
-
-		// Set the client entry for the allowed ip of the host
-		for _, peer := range qm.qc.peers {
-			if peer.endpoint == host {
-				qm.clients[peer.allowedIPs[0]] = NewClient(host, qm.qc.nodeInterface.localNodeIP, qm.qc.nodeInterface.listenPort, qm.localIf, s.logger)
-				qm.clients[host].SetConnection(conn)
-			}
+		s.logger.Infof("Accepted connection from %v and local address is %v", conn.RemoteAddr(), conn.LocalAddr())
+		// The handshake only completes for registered peers, find out which one connected
+		var remote *peerState
+		if certs := conn.ConnectionState().TLS.PeerCertificates; len(certs) > 0 {
+			remote, err = qm.peerForCert(certs[0])
+		}
+		if remote == nil {
+			s.logger.Warnf("Closing connection from %v with unknown identity: %v", conn.RemoteAddr(), err)
+			_ = conn.CloseWithError(errCodeUnknownPeer, "unknown peer")
+			continue
 		}
 
+		c, err := NewClient(conn.RemoteAddr().String(), remote.identity(), qm.qc.nodeInterface.localNodeIP, qm.qc.nodeInterface.listenPort, nil, nil, s.logger)
 		if err != nil {
-			return err
+			s.logger.Errorf("Closing connection from %v: %v", conn.RemoteAddr(), err)
+			_ = conn.CloseWithError(errCodeShutdown, "internal error")
+			continue
 		}
-		go func() {
-			err := handleMsg(s.tunnelInterface, conn, s.handler)
-			if err != nil {
-				fmt.Printf("handler err: %v", err)
-			}
-		}()
+		c.SetConnection(conn)
+		if !qm.setClient(remote, c) {
+			continue
+		}
+
+		qm.receive(conn, remote, s.handler)
 	}
 }
@@ -0,0 +1,47 @@
+package quicwire
+
+import "sync/atomic"
+
+// peerStats holds the packet counters of a peer
+type peerStats struct {
+	// packets received with a source address outside of the peer's AllowedIPs
+	spoofedPackets atomic.Uint64
+	// packets received that are not valid IPv4 or IPv6 packets
+	invalidPackets atomic.Uint64
+	// bytes of the packets received from and sent to the peer
+	rxBytes atomic.Uint64
+	txBytes atomic.Uint64
+	// packets for the peer dropped because it isn't connected or doesn't keep up
+	droppedPackets atomic.Uint64
+}
+
+// Stats holds the counters of the node, summed over its current peers
+type Stats struct {
+	Peers int
+	// ConnectedPeers is the number of peers with an established connection
+	ConnectedPeers int
+	RxBytes        uint64
+	TxBytes        uint64
+	SpoofedPackets uint64
+	InvalidPackets uint64
+	// DroppedPackets counts the packets for a peer that were dropped because
+	// it wasn't connected or its send queue was full
+	DroppedPackets uint64
+}
+
+// Stats returns the counters of the node
+func (qn *QuicWire) Stats() Stats {
+	var stats Stats
+	for _, p := range qn.peers.all() {
+		stats.Peers++
+		if p.connState() == peerEstablished {
+			stats.ConnectedPeers++
+		}
+		stats.RxBytes += p.stats.rxBytes.Load()
+		stats.TxBytes += p.stats.txBytes.Load()
+		stats.SpoofedPackets += p.stats.spoofedPackets.Load()
+		stats.InvalidPackets += p.stats.invalidPackets.Load()
+		stats.DroppedPackets += p.stats.droppedPackets.Load()
+	}
+	return stats
+}
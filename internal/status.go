@@ -0,0 +1,78 @@
+package quicwire
+
+import (
+	"net/netip"
+	"time"
+)
+
+// InterfaceStatus describes the node and its peers
+type InterfaceStatus struct {
+	// Name of the tunnel interface
+	Name string
+	// PublicKey of the node, empty when a CA is used
+	PublicKey  string
+	ListenPort int
+	Peers      []PeerStatus
+}
+
+// PeerStatus describes a peer and the state of its connection
+type PeerStatus struct {
+	// Identity is the public key or certificate name of the peer
+	Identity   string
+	AllowedIPs []netip.Prefix
+	// Endpoint is the configured address of the peer, if any
+	Endpoint string
+	// LearnedEndpoint is the address of the latest connection with the peer,
+	// it changes when the peer roams
+	LearnedEndpoint string
+	State           string
+	// LastHandshake is the time the current connection was established, zero
+	// while the peer isn't connected
+	LastHandshake  time.Time
+	RxBytes        uint64
+	TxBytes        uint64
+	SpoofedPackets uint64
+	InvalidPackets uint64
+	// LastError is the latest failure of the peer, such as a failed dial or
+	// route, and LastErrorTime the time it happened
+	LastError     string
+	LastErrorTime time.Time
+}
+
+// Status returns the status of the node and of every peer, ordered by
+// identity. The interface fields are only set once the node is running.
+func (qn *QuicWire) Status() InterfaceStatus {
+	var status InterfaceStatus
+	if qn.running.Load() {
+		status.Name = qn.localIf.Name()
+		status.ListenPort = qn.qc.nodeInterface.listenPort
+		if !qn.qc.nodeInterface.usesCA() {
+			status.PublicKey = qn.qc.nodeInterface.privateKey.PublicKey().String()
+		}
+	}
+	for _, p := range qn.peers.all() {
+		conf := p.config()
+		s := PeerStatus{
+			Identity:       p.identity(),
+			AllowedIPs:     conf.allowedIPs,
+			Endpoint:       conf.endpoint,
+			State:          p.connState().String(),
+			RxBytes:        p.stats.rxBytes.Load(),
+			TxBytes:        p.stats.txBytes.Load(),
+			SpoofedPackets: p.stats.spoofedPackets.Load(),
+			InvalidPackets: p.stats.invalidPackets.Load(),
+		}
+		if learned := p.learnedEndpoint.Load(); learned != nil {
+			s.LearnedEndpoint = *learned
+		}
+		if c := p.client.Load(); c != nil {
+			s.LastHandshake = c.since
+		}
+		if lastErr := p.lastErr.Load(); lastErr != nil {
+			s.LastError = lastErr.err.Error()
+			s.LastErrorTime = lastErr.time
+		}
+		status.Peers = append(status.Peers, s)
+	}
+	return status
+}
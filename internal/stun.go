@@ -7,7 +7,6 @@ import (
 
 	"github.com/libp2p/go-reuseport"
 	"github.com/pion/stun"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -21,18 +20,15 @@ const (
 func IsSymmetricNAT(sourcePort int) (bool, error) {
 	firstStun, err := StunRequest(stunServer1, sourcePort)
 	if err != nil {
-		return false, fmt.Errorf("failed to query the STUN server %s", stunServer1)
+		return false, fmt.Errorf("failed to query the STUN server %s: %w", stunServer1, err)
 	}
-	log.Infof("STUN Result from %s => [ %s ]", stunServer1, firstStun)
 	secondStun, err := StunRequest(stunServer2, sourcePort)
 	if err != nil {
-		return false, fmt.Errorf("failed to query the STUN server %s", stunServer1)
+		return false, fmt.Errorf("failed to query the STUN server %s: %w", stunServer2, err)
 	}
 	if firstStun != secondStun {
 		return true, nil
 	}
-	log.Infof("STUN Result from %s => [ %s ]", stunServer1, secondStun)
-
 	return false, nil
 }
 
@@ -48,19 +44,15 @@ func GetPortBinding(sourcePort int) (string, error) {
 
 // StunRequest initiate a connection to a STUN server sourced from the wg src port
 func StunRequest(stunServer string, srcPort int) (string, error) {
-
-	log.Debugf("dialing stun server %s", stunServer)
-
-	conn, err := reuseport.Dial("udp4", fmt.Sprintf(":%d", srcPort), stunServer)
+	conn, err := reuseport.Dial("udp", fmt.Sprintf(":%d", srcPort), stunServer)
 	if err != nil {
-		log.Errorf("stun dialing timed out %v", err)
 		return "", fmt.Errorf("failed to dial stun server %s: %w", stunServer, err)
 	}
 
 	defer conn.Close()
 	stunResults, err := stunDialer(&conn)
 	if err != nil {
-		return "", fmt.Errorf("stun dialing timed out %w", err)
+		return "", fmt.Errorf("stun request to %s failed: %w", stunServer, err)
 	}
 	return stunResults, nil
 }
@@ -68,38 +60,29 @@ func StunRequest(stunServer string, srcPort int) (string, error) {
 func stunDialer(conn *net.Conn) (string, error) {
 	c, err := stun.NewClient(*conn)
 	if err != nil {
-		log.Errorf("%v", err)
+		return "", fmt.Errorf("failed to create stun client: %w", err)
 	}
+	defer c.Close()
+
 	var xorAddr stun.XORMappedAddress
+	var resErr error
 	if err = c.Do(stun.MustBuild(stun.TransactionID, stun.BindingRequest), func(res stun.Event) {
 		if res.Error != nil {
-			log.Println(res.Error)
+			resErr = res.Error
 			return
 		}
 		if getErr := xorAddr.GetFrom(res.Message); getErr != nil {
-			log.Println(getErr)
-			if err := c.Close(); err != nil {
-				log.Println(err)
-				return
-			}
+			resErr = fmt.Errorf("invalid stun response: %w", getErr)
 			return
 		}
-		log.Debugf("Stun address and port is: %s:%d", xorAddr.IP, xorAddr.Port)
-
 	}); err != nil {
 		return "", err
 	}
-	if err := c.Close(); err != nil {
-		return "", err
+	if resErr != nil {
+		return "", resErr
 	}
-
 	if xorAddr.IP == nil {
 		return "", fmt.Errorf("no response")
 	}
-	stunAddress := net.JoinHostPort(xorAddr.IP.String(), strconv.Itoa(xorAddr.Port))
-	if err != nil {
-		return "", err
-	}
-
-	return stunAddress, nil
+	return net.JoinHostPort(xorAddr.IP.String(), strconv.Itoa(xorAddr.Port)), nil
 }
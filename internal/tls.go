@@ -0,0 +1,242 @@
+package quicwire
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+const (
+	alpnProtocol = "quicwire"
+	certLifetime = 24 * time.Hour
+)
+
+// newCertificate creates a self-signed certificate carrying the node's public key.
+// The certificate itself is not trusted by peers, only the key inside it.
+func newCertificate(key PrivateKey) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	signer := key.signer()
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: key.PublicKey().String()},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, signer.Public(), signer)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  signer,
+	}, nil
+}
+
+// certPublicKey extracts the Ed25519 public key from a peer certificate.
+// The TLS handshake has already proven that the remote holds the matching private key.
+func certPublicKey(cert *x509.Certificate) (PublicKey, error) {
+	var pub PublicKey
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return pub, fmt.Errorf("peer certificate does not carry an Ed25519 key")
+	}
+	copy(pub[:], key)
+	return pub, nil
+}
+
+// certMatchesName reports whether the certificate was issued for name, either
+// as a DNS subject alternative name or as the common name.
+func certMatchesName(cert *x509.Certificate, name string) bool {
+	if cert.VerifyHostname(name) == nil {
+		return true
+	}
+	return cert.Subject.CommonName == name
+}
+
+// leafCertificate parses the first certificate presented by the remote side
+func leafCertificate(rawCerts [][]byte) (*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, fmt.Errorf("peer did not present a certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// peerForCert returns the registered peer that owns the authenticated certificate
+func (qn *QuicWire) peerForCert(cert *x509.Certificate) (*peerState, error) {
+	if qn.qc.nodeInterface.usesCA() {
+		for _, p := range qn.peers.all() {
+			if certMatchesName(cert, p.config().name) {
+				return p, nil
+			}
+		}
+		return nil, fmt.Errorf("no peer configured for certificate %q", cert.Subject.CommonName)
+	}
+	pub, err := certPublicKey(cert)
+	if err != nil {
+		return nil, err
+	}
+	if p := qn.peers.get(pub.String()); p != nil {
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown peer key %s", pub)
+}
+
+// peerMatchesCert reports an error unless the authenticated certificate belongs to peer
+func (qc *QuicConf) peerMatchesCert(peer Peer, cert *x509.Certificate) error {
+	if qc.nodeInterface.usesCA() {
+		if !certMatchesName(cert, peer.name) {
+			return fmt.Errorf("peer at %s presented a certificate for %q, expected %q", peer.endpoint, cert.Subject.CommonName, peer.name)
+		}
+		return nil
+	}
+	pub, err := certPublicKey(cert)
+	if err != nil {
+		return err
+	}
+	if pub != peer.publicKey {
+		return fmt.Errorf("peer at %s presented key %s, expected %s", peer.endpoint, pub, peer.publicKey)
+	}
+	return nil
+}
+
+// nodeCertificate returns the certificate the node presents to its peers
+func (ni *nodeInterface) nodeCertificate() (tls.Certificate, error) {
+	if ni.usesCA() {
+		cert, err := tls.LoadX509KeyPair(ni.certFile, ni.keyFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to load node certificate: %w", err)
+		}
+		return cert, nil
+	}
+	return newCertificate(ni.privateKey)
+}
+
+// publicKeyInfo returns the DER encoded public key of the node certificate
+func (ni *nodeInterface) publicKeyInfo() ([]byte, error) {
+	cert, err := ni.nodeCertificate()
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse node certificate: %w", err)
+	}
+	return leaf.RawSubjectPublicKeyInfo, nil
+}
+
+// caPool loads the CA bundle used to verify peer certificates
+func (ni *nodeInterface) caPool() (*x509.CertPool, error) {
+	pem, err := os.ReadFile(ni.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", ni.caFile)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig returns the TLS config used to accept connections. Only
+// clients authenticating as a configured peer complete the handshake.
+func (qn *QuicWire) serverTLSConfig() (*tls.Config, error) {
+	cert, err := qn.qc.nodeInterface.nodeCertificate()
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		NextProtos:   []string{alpnProtocol},
+		MinVersion:   tls.VersionTLS13,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			cert, err := leafCertificate(rawCerts)
+			if err != nil {
+				return err
+			}
+			_, err = qn.peerForCert(cert)
+			return err
+		},
+	}
+	if qn.qc.nodeInterface.usesCA() {
+		pool, err := qn.qc.nodeInterface.caPool()
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConf.ClientCAs = pool
+	}
+	return tlsConf, nil
+}
+
+// clientTLSConfig returns the TLS config used to dial the given peer. The
+// server must authenticate as exactly that peer.
+func (qn *QuicWire) clientTLSConfig(peer Peer) (*tls.Config, error) {
+	cert, err := qn.qc.nodeInterface.nodeCertificate()
+	if err != nil {
+		return nil, err
+	}
+	var roots *x509.CertPool
+	if qn.qc.nodeInterface.usesCA() {
+		if roots, err = qn.qc.nodeInterface.caPool(); err != nil {
+			return nil, err
+		}
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{alpnProtocol},
+		MinVersion:   tls.VersionTLS13,
+		// The standard verification is replaced by VerifyPeerCertificate, which
+		// checks the pinned peer key, or the CA chain and the SAN or CN of the peer.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			cert, err := leafCertificate(rawCerts)
+			if err != nil {
+				return err
+			}
+			if roots != nil {
+				if err := verifyChain(cert, rawCerts[1:], roots); err != nil {
+					return err
+				}
+			}
+			return qn.qc.peerMatchesCert(peer, cert)
+		},
+	}, nil
+}
+
+// verifyChain verifies that the server certificate was issued by one of the roots
+func verifyChain(leaf *x509.Certificate, rawIntermediates [][]byte, roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	for _, raw := range rawIntermediates {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse peer certificate: %w", err)
+		}
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify peer certificate: %w", err)
+	}
+	return nil
+}
@@ -3,45 +3,46 @@
 package quicwire
 
 import (
+	"errors"
 	"fmt"
-	"net"
 	"os/exec"
 	"strconv"
-
-	"github.com/songgao/water"
 )
 
 func (qn *QuicWire) createTunIface() error {
 	// Create a TUN interface
-	iface, err := water.New(water.Config{DeviceType: water.TUN})
+	iface, err := newWaterDevice(qn.tunMTU())
 	if err != nil {
 		return fmt.Errorf("failed to create Tun interface: %w", err)
 	}
 	qn.logger.Debugf("TUN interface created: %s", iface.Name())
 
-	// Assign an IP address to the TUN interface
-	ip, _, err := net.ParseCIDR(qn.qc.nodeInterface.localEndpoint)
-	if err != nil {
-		// If it's not a CIDR, treat it as a plain IP supplied and append a /24 as a default prefix for convenience
-		ip = net.ParseIP(qn.qc.nodeInterface.localEndpoint)
-		if ip == nil {
-			return fmt.Errorf("invalid IP address format: %s", qn.qc.nodeInterface.localEndpoint)
+	// Assign the IP addresses to the TUN interface
+	for _, prefix := range qn.qc.nodeInterface.localEndpoint {
+		ip := prefix.Addr()
+		var cmd *exec.Cmd
+		if ip.Is4() {
+			cmd = exec.Command("ifconfig", iface.Name(), "inet", ip.String(), ip.String(), "alias")
+			qn.logger.Infof("Interface %s is being assigned the address %s with remote address %s as an alias", iface.Name(), ip.String(), ip.String())
+		} else {
+			cmd = exec.Command("ifconfig", iface.Name(), "inet6", ip.String(), "prefixlen", strconv.Itoa(prefix.Bits()), "alias")
+			qn.logger.Infof("Interface %s is being assigned the address %s as an alias", iface.Name(), prefix.String())
 		}
-	}
+		qn.logger.Infof("Running command: %v", cmd)
 
-	cmd := exec.Command("ifconfig", iface.Name(), "inet", ip.String(), ip.String(), "alias")
-	qn.logger.Infof("Interface %s is being assigned the address %s with remote address %s as an alias", iface.Name(), ip.String(), ip.String())
-	qn.logger.Infof("Running command: %v", cmd)
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to assign IP address to TUN interface: %w", err)
+		if err := cmd.Run(); err != nil {
+			// Stop only closes the interface once it is the localIf of the node
+			iface.Close()
+			return fmt.Errorf("failed to assign IP address to TUN interface: %w", err)
+		}
 	}
 	qn.logger.Debugf("IP address assigned to TUN interface")
 
 	// Set the MTU
-	tunDevMTUString := strconv.Itoa(tunDevMTU)
-	cmd = exec.Command("ifconfig", iface.Name(), "mtu", tunDevMTUString)
+	tunDevMTUString := strconv.Itoa(iface.MTU())
+	cmd := exec.Command("ifconfig", iface.Name(), "mtu", tunDevMTUString)
 	if err := cmd.Run(); err != nil {
+		iface.Close()
 		return fmt.Errorf("failed to set the MTU: %v", err)
 	}
 
@@ -51,3 +52,19 @@ func (qn *QuicWire) createTunIface() error {
 
 	return nil
 }
+
+// cleanupTunIface removes the addresses assigned to the TUN interface
+func (qn *QuicWire) cleanupTunIface() error {
+	var errs []error
+	for _, prefix := range qn.qc.nodeInterface.localEndpoint {
+		family := "inet"
+		if prefix.Addr().Is6() {
+			family = "inet6"
+		}
+		cmd := exec.Command("ifconfig", qn.localIf.Name(), family, prefix.Addr().String(), "-alias")
+		if err := cmd.Run(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove IP address %s from TUN interface: %w", prefix.Addr(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -3,59 +3,66 @@
 package quicwire
 
 import (
-	"fmt"
-	"net"
-	"os/exec"
+	"errors"
 	"strconv"
 
-	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
 )
 
 func (qn *QuicWire) createTunIface() error {
 	// Create a TUN interface
-	iface, err := water.New(water.Config{DeviceType: water.TUN})
+	mtu := qn.tunMTU()
+	iface, err := newNativeTun("", mtu)
 	if err != nil {
-		return fmt.Errorf("failed to create Tun interface: %w", err)
+		return err
 	}
 	qn.logger.Debugf("TUN interface created: %s", iface.Name())
+	qn.localIf = iface
 
-	// Assign an IP address to the TUN interface
-	var tunnelIPStr string
-	ip, ipNet, err := net.ParseCIDR(qn.qc.nodeInterface.localEndpoint)
+	link, err := netlink.LinkByName(iface.Name())
 	if err != nil {
-		// If it's not a CIDR, append a /24 as a default prefix for convenience of not having to add a route for convenience
-		ip = net.ParseIP(qn.qc.nodeInterface.localEndpoint)
-		if ip == nil {
-			return fmt.Errorf("invalid IP address format: %s", qn.qc.nodeInterface.localEndpoint)
-		}
-		tunnelIPStr = fmt.Sprintf("%s/24", ip.String())
-	} else {
-		// If a mask was supplied honor it here
-		ones, _ := ipNet.Mask.Size()
-		tunnelIPStr = fmt.Sprintf("%s/%d", ip.String(), ones)
+		return &LinkError{Op: "find link", Link: iface.Name(), Err: err}
 	}
 
-	cmd := exec.Command("ip", "addr", "add", tunnelIPStr, "dev", iface.Name())
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to assign IP address to TUN interface: %w", err)
+	// Set the MTU first, IPv6 addresses can't be assigned to links with an MTU below 1280
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return &LinkError{Op: "set mtu", Link: iface.Name(), Arg: strconv.Itoa(mtu), Err: err}
 	}
-	qn.logger.Debugf("IP address assigned to TUN interface")
 
-	// Set the MTU
-	tunDevMTUString := strconv.Itoa(tunDevMTU)
-	cmd = exec.Command("ip", "link", "set", "dev", iface.Name(), "mtu", tunDevMTUString)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to set the MTU: %v", err)
+	// Assign the IP addresses to the TUN interface
+	for _, prefix := range qn.qc.nodeInterface.localEndpoint {
+		addr := &netlink.Addr{IPNet: prefixToIPNet(prefix)}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return &LinkError{Op: "add address", Link: iface.Name(), Arg: prefix.String(), Err: err}
+		}
 	}
+	qn.logger.Debugf("IP address assigned to TUN interface")
 
 	// Up the TUN interface
-	cmd = exec.Command("ip", "link", "set", "dev", iface.Name(), "up")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to change the state to UP for the TUN interface: %v", err)
+	if err := netlink.LinkSetUp(link); err != nil {
+		return &LinkError{Op: "set link up", Link: iface.Name(), Err: err}
 	}
 
 	qn.logger.Debugf("TUN interface %s is up and running", iface.Name())
-	qn.localIf = iface
 
 	return nil
 }
+
+// cleanupTunIface removes the addresses assigned to the TUN interface and sets it down
+func (qn *QuicWire) cleanupTunIface() error {
+	link, err := netlink.LinkByName(qn.localIf.Name())
+	if err != nil {
+		return &LinkError{Op: "find link", Link: qn.localIf.Name(), Err: err}
+	}
+	var errs []error
+	for _, prefix := range qn.qc.nodeInterface.localEndpoint {
+		addr := &netlink.Addr{IPNet: prefixToIPNet(prefix)}
+		if err := netlink.AddrDel(link, addr); err != nil {
+			errs = append(errs, &LinkError{Op: "remove address", Link: qn.localIf.Name(), Arg: prefix.String(), Err: err})
+		}
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		errs = append(errs, &LinkError{Op: "set link down", Link: qn.localIf.Name(), Err: err})
+	}
+	return errors.Join(errs...)
+}
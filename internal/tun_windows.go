@@ -3,39 +3,80 @@
 package quicwire
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os/exec"
-
-	"github.com/songgao/water"
+	"strconv"
 )
 
 func (qn *QuicWire) createTunIface() error {
 	// Create a TUN interface
-	iface, err := water.New(water.Config{DeviceType: water.TUN})
+	iface, err := newWaterDevice(qn.tunMTU())
 	if err != nil {
 		return fmt.Errorf("failed to create Tun interface: %w", err)
 	}
 	qn.logger.Debugf("TUN interface created: %s", iface.Name())
 
-	// Assign an IP address to the TUN interface
-	ip, _, err := net.ParseCIDR(qn.qc.nodeInterface.localEndpoint)
-	if err != nil {
-		// If it's not a CIDR, treat it as a plain IP supplied and append a /24 as a default prefix for convenience
-		ip = net.ParseIP(qn.qc.nodeInterface.localEndpoint)
-		if ip == nil {
-			return fmt.Errorf("invalid IP address format: %s", qn.qc.nodeInterface.localEndpoint)
+	// Assign IPs using netsh. The first IPv4 address replaces the one the
+	// interface got from Windows, the next ones are added to it.
+	staticIPv4 := false
+	for _, prefix := range qn.qc.nodeInterface.localEndpoint {
+		var cmd *exec.Cmd
+		if prefix.Addr().Is4() {
+			mask := net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+			if !staticIPv4 {
+				cmd = exec.Command("netsh", "interface", "ip", "set", "address", iface.Name(), "static", prefix.Addr().String(), mask)
+				staticIPv4 = true
+			} else {
+				cmd = exec.Command("netsh", "interface", "ip", "add", "address", iface.Name(), prefix.Addr().String(), mask)
+			}
+		} else {
+			cmd = exec.Command("netsh", "interface", "ipv6", "add", "address", iface.Name(), prefix.String())
+		}
+		if err := cmd.Run(); err != nil {
+			// Stop only closes the interface once it is the localIf of the node
+			iface.Close()
+			return fmt.Errorf("failed to assign IP address %s to TUN interface: %w", prefix, err)
 		}
 	}
+	qn.logger.Debugf("IP address assigned to TUN interface")
 
-	// Assign IP using netsh
-	cmd := exec.Command("netsh", "interface", "ip", "set", "address", iface.Name(), "static", ip.String(), "255.255.255.0")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to assign IP address to TUN interface: %w", err)
+	// Set the MTU, the interface keeps the default of 1500 otherwise and
+	// returns packets larger than the buffers of the node
+	mtu := "mtu=" + strconv.Itoa(iface.MTU())
+	families := []string{"ipv4"}
+	for _, prefix := range qn.qc.nodeInterface.localEndpoint {
+		if prefix.Addr().Is6() {
+			families = append(families, "ipv6")
+			break
+		}
+	}
+	for _, family := range families {
+		cmd := exec.Command("netsh", "interface", family, "set", "subinterface", iface.Name(), mtu, "store=active")
+		if err := cmd.Run(); err != nil {
+			iface.Close()
+			return fmt.Errorf("failed to set the %s MTU: %w", family, err)
+		}
 	}
-	qn.logger.Debugf("IP address assigned to TUN interface")
 	qn.logger.Debugf("TUN interface %s is up and running", iface.Name())
 	qn.localIf = iface
 
 	return nil
 }
+
+// cleanupTunIface removes the addresses assigned to the TUN interface
+func (qn *QuicWire) cleanupTunIface() error {
+	var errs []error
+	for _, prefix := range qn.qc.nodeInterface.localEndpoint {
+		family := "ip"
+		if prefix.Addr().Is6() {
+			family = "ipv6"
+		}
+		cmd := exec.Command("netsh", "interface", family, "delete", "address", qn.localIf.Name(), prefix.Addr().String())
+		if err := cmd.Run(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove IP address %s from TUN interface: %w", prefix.Addr(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
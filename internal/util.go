@@ -2,57 +2,40 @@ package quicwire
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
-	"math/big"
-	"os"
+	"errors"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/quic-go/quic-go"
-	"github.com/songgao/water"
 )
 
 // Handler is a function that processes incoming packets
 type Handler func(packetContext) error
 
-// Setup a bare-bones TLS config for the server
-func getTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		panic(err)
-	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		panic(err)
-	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		panic(err)
-	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"some-proto"},
-	}
-}
-
-func handleMsg(tunIP *water.Interface, conn quic.Connection, handler Handler) error {
+// handleMsg passes the packets received from peer over conn to the handler.
+// Packets rebuilt from fragments are held by buffers of pool.
+func handleMsg(tunIP Device, conn *quic.Conn, peer *peerState, pool *packetPool, handler Handler) error {
+	r := newReassembler(pool)
 	for {
-		data, err := conn.ReceiveMessage()
+		datagram, err := conn.ReceiveDatagram(context.Background())
 		if err != nil {
 			return err
 		}
+		if len(datagram) == 0 {
+			// Empty datagrams are keepalives
+			continue
+		}
+		data, buf, err := r.add(datagram)
+		if err != nil || data == nil {
+			// Malformed fragments are dropped, complete packets need more fragments
+			continue
+		}
 		err = handler(packetContext{
-			localIf:    tunIP,
-			Connection: conn,
-			Data:       data,
+			localIf: tunIP,
+			Conn:    conn,
+			peer:    peer,
+			Data:    data,
+			buf:     buf,
 		})
 		if err != nil {
 			return err
@@ -60,23 +43,28 @@ func handleMsg(tunIP *water.Interface, conn quic.Connection, handler Handler) er
 	}
 }
 
-// RetryOperation retries the operation with a backoff policy.
-func RetryOperation(ctx context.Context, wait time.Duration, retries int, operation func() error) error {
-	bo := backoff.WithMaxRetries(
-		backoff.NewConstantBackOff(wait),
-		uint64(retries),
-	)
-	bo = backoff.WithContext(bo, ctx)
-	err := backoff.Retry(operation, bo)
+// closedByShutdown reports whether err comes from closing the connection locally on shutdown
+func closedByShutdown(err error) bool {
+	var appErr *quic.ApplicationError
+	return errors.As(err, &appErr) && !appErr.Remote && appErr.ErrorCode == errCodeShutdown
+}
 
-	return err
+// closedAsDuplicate reports whether err comes from closing a duplicate connection, on either side
+func closedAsDuplicate(err error) bool {
+	var appErr *quic.ApplicationError
+	return errors.As(err, &appErr) && appErr.ErrorCode == errCodeDuplicate
 }
 
-func getHostname() string {
-	name, err := os.Hostname()
-	if err != nil {
-		panic(err)
-	}
+// RetryOperation retries the operation with an exponential backoff policy,
+// waiting wait before the first retry and at most maxWait between retries.
+func RetryOperation(ctx context.Context, wait time.Duration, maxWait time.Duration, retries int, operation func() error) error {
+	expBackoff := backoff.NewExponentialBackOff()
+	expBackoff.InitialInterval = wait
+	expBackoff.MaxInterval = maxWait
+	expBackoff.MaxElapsedTime = 0
+	bo := backoff.WithMaxRetries(expBackoff, uint64(retries))
+	bo = backoff.WithContext(bo, ctx)
+	err := backoff.Retry(operation, bo)
 
-	return name
+	return err
 }
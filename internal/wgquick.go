@@ -0,0 +1,128 @@
+package quicwire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ConvertWgQuick rewrites the wg-quick file read from r in the quicwire
+// format to w. Comments are kept, Address becomes LocalEndpoint, the keys
+// quicwire ignores are commented out and the defaults of ListenPort and
+// LocalNodeIp are written out. WireGuard keys can't be converted: the node
+// gets a new PrivateKey, and the PublicKey of each peer becomes a placeholder
+// that must be replaced with the quicwire public key of the peer before the
+// file can be used.
+func ConvertWgQuick(file string, r io.Reader, w io.Writer) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	cp := &confParser{qc: &QuicConf{}, file: file, converting: true}
+	if err := cp.parse(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	privateKey, err := GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+
+	// Find the keys missing from the [Interface] section first, they are
+	// written right after its header
+	interfaceKeys := make(map[string]bool)
+	section := ""
+	for _, line := range lines {
+		if header, ok := sectionHeader(line); ok {
+			section = header
+		} else if key, _, ok := lineKey(line, section); ok && section == sectionInterface {
+			interfaceKeys[key] = true
+		}
+	}
+	if !interfaceKeys["Address"] {
+		return &ConfigError{File: file, Err: fmt.Errorf("not a wg-quick file, its [Interface] section has no Address")}
+	}
+
+	var out bytes.Buffer
+	section = ""
+	for _, line := range lines {
+		if header, ok := sectionHeader(line); ok {
+			section = header
+			fmt.Fprintln(&out, line)
+			if section == sectionInterface {
+				if !interfaceKeys["LocalNodeIp"] {
+					fmt.Fprintln(&out, "# Address of the node the server listens on, every address by default")
+					fmt.Fprintf(&out, "LocalNodeIp = %s\n", defaultLocalNodeIP)
+				}
+				if !interfaceKeys["ListenPort"] {
+					fmt.Fprintf(&out, "ListenPort = %d\n", defaultListenPort)
+				}
+			}
+			continue
+		}
+		key, rest, ok := lineKey(line, section)
+		if !ok {
+			fmt.Fprintln(&out, line)
+			continue
+		}
+		switch {
+		case key == "Address":
+			fmt.Fprintf(&out, "LocalEndpoint =%s\n", rest)
+		case key == "PresharedKey":
+			// The key is secret, so it isn't kept in a comment
+			fmt.Fprintf(&out, "# PresharedKey removed, %s\n", wgQuickKeys[key])
+		case wgQuickKeys[key] != "":
+			fmt.Fprintf(&out, "# %s  (ignored, %s)\n", strings.TrimSpace(line), wgQuickKeys[key])
+		case key == "PrivateKey":
+			// The WireGuard key is secret, so it isn't kept in a comment
+			fmt.Fprintf(&out, "# New quicwire key replacing the WireGuard PrivateKey, the public key of this node is %s\n", privateKey.PublicKey())
+			fmt.Fprintf(&out, "PrivateKey = %s\n", privateKey)
+		case key == "PublicKey":
+			fmt.Fprintf(&out, "# WireGuard PublicKey %s, replace the placeholder with the quicwire public key of the peer\n", strings.TrimSpace(stripComment(rest)))
+			fmt.Fprintf(&out, "PublicKey = %s\n", peerKeyPlaceholder)
+		default:
+			fmt.Fprintln(&out, line)
+		}
+	}
+
+	// The converted config is checked with a key of its own in place of each placeholder
+	converted := out.String()
+	for strings.Contains(converted, peerKeyPlaceholder) {
+		key, err := GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		converted = strings.Replace(converted, peerKeyPlaceholder, key.PublicKey().String(), 1)
+	}
+	if err := parseQuicConf(&QuicConf{}, file, strings.NewReader(converted)); err != nil {
+		return fmt.Errorf("converted config is invalid: %w", err)
+	}
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// sectionHeader returns the canonical name of the section started by line
+func sectionHeader(line string) (string, bool) {
+	text := strings.TrimSpace(stripComment(line))
+	if !strings.HasPrefix(text, "[") || !strings.HasSuffix(text, "]") {
+		return "", false
+	}
+	name := strings.TrimSpace(text[1 : len(text)-1])
+	for _, section := range []string{sectionInterface, sectionPeer} {
+		if strings.EqualFold(name, section) {
+			return section, true
+		}
+	}
+	return name, true
+}
+
+// lineKey returns the canonical key set by line and the text that follows "="
+func lineKey(line string, section string) (string, string, bool) {
+	key, rest, ok := strings.Cut(line, "=")
+	if !ok || strings.Contains(key, "#") {
+		return "", "", false
+	}
+	canonical, ok := configKeys[section][strings.ToLower(strings.TrimSpace(key))]
+	return canonical, rest, ok
+}
@@ -0,0 +1,216 @@
+// Package quicwire embeds a quicwire node in a Go program. A Node is built
+// from a Config, which holds the same settings as the config files of qw, and
+// exchanges packets with its peers through a TUN interface, a Device given in
+// Options, or a userspace TCP/IP stack.
+//
+// Errors are returned to the caller, the package never exits the process. An
+// error that stops a running node is reported by Err once Done is closed.
+package quicwire
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	quicwire "github.com/nexodus-io/quicwire/internal"
+	"go.uber.org/zap"
+)
+
+type (
+	// Config is the configuration of a node
+	Config = quicwire.Config
+	// InterfaceConfig configures the tunnel interface and the identity of the node
+	InterfaceConfig = quicwire.InterfaceConfig
+	// PeerConfig configures a peer of the node
+	PeerConfig = quicwire.PeerConfig
+	// Duration is a duration of the config, written as a number of seconds
+	// or a string with a unit in JSON and YAML
+	Duration = quicwire.Duration
+	// ConfigError is an invalid setting of the config
+	ConfigError = quicwire.ConfigError
+
+	// Device is the packet device of the tunnel
+	Device = quicwire.Device
+	// MemoryDevice is a Device in memory
+	MemoryDevice = quicwire.MemoryDevice
+	// Netstack is a userspace TCP/IP stack terminating the tunnel
+	Netstack = quicwire.Netstack
+
+	// InterfaceStatus describes the node and its peers
+	InterfaceStatus = quicwire.InterfaceStatus
+	// PeerStatus describes a peer and the state of its connection
+	PeerStatus = quicwire.PeerStatus
+	// Stats holds the counters of the node, summed over its peers
+	Stats = quicwire.Stats
+
+	// Event reports a change of the node or of one of its peers
+	Event = quicwire.Event
+	// EventType tells what an Event reports
+	EventType = quicwire.EventType
+)
+
+// The types of Event
+const (
+	EventPeerAdded   = quicwire.EventPeerAdded
+	EventPeerUpdated = quicwire.EventPeerUpdated
+	EventPeerRemoved = quicwire.EventPeerRemoved
+	EventPeerState   = quicwire.EventPeerState
+	EventPeerRoamed  = quicwire.EventPeerRoamed
+	EventPeerError   = quicwire.EventPeerError
+	EventNodeFailed  = quicwire.EventNodeFailed
+)
+
+// configName names the configuration of a Node in errors and logs
+const configName = "config"
+
+// Options are the settings of a Node that aren't part of its Config
+type Options struct {
+	// Logger receives the logs of the node, which are discarded when nil
+	Logger *zap.Logger
+	// Device replaces the TUN interface. Its addresses and routes are left
+	// to the caller.
+	Device Device
+	// Netstack terminates the tunnel in a userspace TCP/IP stack, reached
+	// through Node.Netstack, so the node needs no privileges
+	Netstack bool
+	// ControlSocket is the path of a control socket serving qw show and qw
+	// set, disabled when empty
+	ControlSocket string
+	// DisableClient stops the node from dialing its peers
+	DisableClient bool
+	// DisableServer stops the node from accepting connections from its peers
+	DisableServer bool
+	// DisableSTUN keeps Start from asking the public STUN servers for the
+	// address of the node, which waits for them when they can't be reached
+	DisableSTUN bool
+}
+
+// Node is a quicwire node
+type Node struct {
+	qw *quicwire.QuicWire
+	wg sync.WaitGroup
+}
+
+// NewNode creates a node from conf, which is validated right away
+func NewNode(conf Config, opts Options) (*Node, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	qw, err := quicwire.NewQuicWire(logger.Sugar(), configName, opts.ControlSocket, opts.DisableClient, opts.DisableServer)
+	if err != nil {
+		return nil, err
+	}
+	if err := qw.UseConfig(conf); err != nil {
+		return nil, err
+	}
+	if opts.Device != nil && opts.Netstack {
+		return nil, errors.New("a node can't have both a Device and a Netstack")
+	}
+	if opts.Device != nil {
+		qw.UseDevice(opts.Device)
+	}
+	if opts.Netstack {
+		qw.EnableNetstack()
+	}
+	if opts.DisableSTUN {
+		qw.DisableSTUN()
+	}
+	return &Node{qw: qw}, nil
+}
+
+// NewMemoryDevice creates a Device in memory
+func NewMemoryDevice(name string, mtu int) *MemoryDevice {
+	return quicwire.NewMemoryDevice(name, mtu)
+}
+
+// GenerateKey returns a new base64 encoded private key for InterfaceConfig.PrivateKey
+func GenerateKey() (string, error) {
+	key, err := quicwire.GeneratePrivateKey()
+	if err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
+
+// PublicKey returns the base64 encoded public key of a private key, which
+// identifies the node in the PeerConfig of the other nodes
+func PublicKey(privateKey string) (string, error) {
+	key, err := quicwire.ParsePrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return key.PublicKey().String(), nil
+}
+
+// ConfigSchema returns the JSON Schema of Config
+func ConfigSchema() []byte {
+	return quicwire.ConfigSchema()
+}
+
+// Start sets up the tunnel and starts connecting to the peers. The node runs
+// until Stop is called or ctx is cancelled. If Start fails, whatever it set
+// up is torn down again.
+func (n *Node) Start(ctx context.Context) error {
+	if err := n.qw.Start(ctx, &n.wg); err != nil {
+		n.Stop()
+		return err
+	}
+	return nil
+}
+
+// Stop closes the connections to the peers, tears the tunnel down and waits
+// until every goroutine of the node ended
+func (n *Node) Stop() {
+	n.qw.Stop()
+	n.wg.Wait()
+}
+
+// Done is closed once the node stops
+func (n *Node) Done() <-chan struct{} {
+	return n.qw.Done()
+}
+
+// Err returns the error that stopped the node, or nil if it was stopped by
+// Stop or by its context
+func (n *Node) Err() error {
+	return n.qw.Err()
+}
+
+// AddPeer adds a peer to the running node and starts connecting to it
+func (n *Node) AddPeer(peer PeerConfig) error {
+	return n.qw.AddPeer(peer)
+}
+
+// RemovePeer removes the peer with the given public key, or certificate name
+// when a CA is used, and closes its connection
+func (n *Node) RemovePeer(identity string) error {
+	return n.qw.SetPeer(quicwire.PeerUpdate{Identity: identity, Remove: true})
+}
+
+// Peers returns the status of every peer, ordered by identity
+func (n *Node) Peers() []PeerStatus {
+	return n.qw.Status().Peers
+}
+
+// Status returns the status of the node and of its peers
+func (n *Node) Status() InterfaceStatus {
+	return n.qw.Status()
+}
+
+// Stats returns the counters of the node
+func (n *Node) Stats() Stats {
+	return n.qw.Stats()
+}
+
+// Events returns the events of the node. The channel is never closed, and
+// events are dropped while it is full, so it should be read continuously.
+func (n *Node) Events() <-chan Event {
+	return n.qw.Events()
+}
+
+// Netstack returns the userspace TCP/IP stack of a node started with
+// Options.Netstack, to dial and listen in the mesh
+func (n *Node) Netstack() *Netstack {
+	return n.qw.Netstack()
+}